@@ -0,0 +1,206 @@
+package memguarded
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// Audit events
+const (
+	AuditStart   = "start"   // the server opened the audit log
+	AuditConnect = "connect" // a client connected, or was refused
+	AuditRequest = "request" // a client asked a command, recorded before running it
+	AuditCommand = "command" // a client ran a command
+)
+
+// AuditRefused is the outcome of a connection refused before any command
+const AuditRefused = "REFUSED"
+
+// auditHashField ends each line, hashing the line before it with the hash of the previous record
+const auditHashField = `,"hash":"`
+
+// AuditRecord is a line of the audit log, a json object ending with the hash of the record chained to the previous one
+type AuditRecord struct {
+	Time        time.Time  `json:"time"`
+	Event       string     `json:"event"`
+	Command     string     `json:"command,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Peer        *AuditPeer `json:"peer,omitempty"`
+	Subject     string     `json:"subject,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"` // sha256 of the client certificate
+	Spki        string     `json:"spki,omitempty"`        // sha256 of the client certificate public key, as in policies and pins
+	Outcome     string     `json:"outcome,omitempty"`     // status of the command, OK or REFUSED for a connection
+	Message     string     `json:"message,omitempty"`
+	Prev        string     `json:"prev"` // hash of the previous record, empty for the first one
+	Hash        string     `json:"hash,omitempty"`
+}
+
+// AuditPeer is the process of the client, from SO_PEERCRED
+type AuditPeer struct {
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+	Pid int32  `json:"pid"`
+	Exe string `json:"exe,omitempty"`
+}
+
+// AuditLog writes the audit records, separated from the debug logs, to an append only file and/or syslog.
+// Each record carries the hash of the previous one, VerifyAuditLog detects a record modified, removed or inserted.
+type AuditLog struct {
+	File   string // appended, the chain continues from its last record
+	Syslog bool   // sends each record to the local syslog with the authpriv facility
+
+	file   *os.File
+	syslog *syslog.Writer
+	prev   string
+	lock   sync.Mutex
+}
+
+// Open verifies the existing file, as a server must not continue a chain already broken, and records the start
+func (a *AuditLog) Open() error {
+	if a.File != "" {
+		if existing, err := os.Open(a.File); err == nil {
+			_, a.prev, err = verifyAuditLog(existing)
+			existing.Close()
+			if err != nil {
+				return errs.WithEF(err, data.WithField("file", a.File), "Audit log is not valid, move it away to start a new one")
+			}
+		} else if !os.IsNotExist(err) {
+			return errs.WithEF(err, data.WithField("file", a.File), "Failed to read audit log")
+		}
+
+		file, err := os.OpenFile(a.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return errs.WithEF(err, data.WithField("file", a.File), "Failed to open audit log")
+		}
+		a.file = file
+	}
+	if a.Syslog {
+		writer, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, "memguarded-audit")
+		if err != nil {
+			a.Close()
+			return errs.WithE(err, "Failed to connect to syslog")
+		}
+		a.syslog = writer
+	}
+	return a.Record(AuditRecord{Event: AuditStart, Outcome: StatusOK.String()})
+}
+
+func (a *AuditLog) Close() {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if a.syslog != nil {
+		a.syslog.Close()
+		a.syslog = nil
+	}
+}
+
+// Record chains and writes record, a nil AuditLog records nothing
+func (a *AuditLog) Record(record AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Time = record.Time.UTC()
+	record.Prev = a.prev
+	record.Hash = ""
+	line, hash, err := chainAuditRecord(record)
+	if err != nil {
+		return err
+	}
+
+	if a.file != nil {
+		if _, err := a.file.Write(line); err != nil {
+			return errs.WithEF(err, data.WithField("file", a.File), "Failed to write audit record")
+		}
+		if err := a.file.Sync(); err != nil {
+			return errs.WithEF(err, data.WithField("file", a.File), "Failed to sync audit log")
+		}
+	}
+	if a.syslog != nil {
+		if err := a.syslog.Info(string(line)); err != nil {
+			return errs.WithE(err, "Failed to send audit record to syslog")
+		}
+	}
+	a.prev = hash
+	return nil
+}
+
+// VerifyAuditLog checks the hash chain of the records read from r and returns their number
+func VerifyAuditLog(r io.Reader) (int, error) {
+	count, _, err := verifyAuditLog(r)
+	return count, err
+}
+
+/////////////////////
+
+// chainAuditRecord returns the line of record, with the hash of its json that includes the previous hash
+func chainAuditRecord(record AuditRecord) ([]byte, string, error) {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return nil, "", errs.WithE(err, "Failed to marshal audit record")
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	line := make([]byte, 0, len(content)+len(auditHashField)+len(hash)+3)
+	line = append(line, content[:len(content)-1]...)
+	line = append(line, auditHashField...)
+	line = append(line, hash...)
+	line = append(line, "\"}\n"...)
+	return line, hash, nil
+}
+
+// verifyAuditLog returns the number of records and the hash of the last one
+func verifyAuditLog(r io.Reader) (int, string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	prev := ""
+	count := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		fields := data.WithField("line", count+1)
+
+		index := bytes.LastIndex(line, []byte(auditHashField))
+		if index < 0 || !bytes.HasSuffix(line, []byte("\"}")) {
+			return count, prev, errs.WithF(fields, "Audit record has no hash")
+		}
+		hash := string(line[index+len(auditHashField) : len(line)-2])
+		content := append(append([]byte{}, line[:index]...), '}')
+
+		var record AuditRecord
+		if err := json.Unmarshal(content, &record); err != nil {
+			return count, prev, errs.WithEF(err, fields, "Invalid audit record")
+		}
+		if record.Prev != prev {
+			return count, prev, errs.WithF(fields, "Audit record does not follow the previous one")
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != hash {
+			return count, prev, errs.WithF(fields, "Audit record was modified")
+		}
+		prev = hash
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, prev, errs.WithE(err, "Failed to read audit log")
+	}
+	return count, prev, nil
+}
@@ -0,0 +1,159 @@
+package memguarded
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAuditRecords(t *testing.T, file string) []AuditRecord {
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	records := []AuditRecord{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var record AuditRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditLog_ChainContinuesAcrossOpen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	audit := &AuditLog{File: file}
+	require.NoError(t, audit.Open())
+	require.NoError(t, audit.Record(AuditRecord{Event: AuditCommand, Command: "get_secret", Name: "db", Outcome: "OK"}))
+	audit.Close()
+
+	audit = &AuditLog{File: file}
+	require.NoError(t, audit.Open())
+	audit.Close()
+
+	records := readAuditRecords(t, file)
+	require.Len(t, records, 3)
+	assert.Equal(t, "", records[0].Prev)
+	assert.Equal(t, records[0].Hash, records[1].Prev)
+	assert.Equal(t, records[1].Hash, records[2].Prev)
+	assert.Equal(t, AuditStart, records[2].Event)
+
+	reader, err := os.Open(file)
+	require.NoError(t, err)
+	defer reader.Close()
+	count, err := VerifyAuditLog(reader)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestVerifyAuditLog_DetectsTampering(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	audit := &AuditLog{File: file}
+	require.NoError(t, audit.Open())
+	for _, name := range []string{"db", "api", "web"} {
+		require.NoError(t, audit.Record(AuditRecord{Event: AuditCommand, Command: "get_secret", Name: name, Outcome: "OK"}))
+	}
+	audit.Close()
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	lines := bytes.SplitAfter(content, []byte("\n"))
+
+	tampered := map[string][]byte{
+		"modified":        bytes.Replace(content, []byte(`"name":"api"`), []byte(`"name":"xxx"`), 1),
+		"removed":         bytes.Join([][]byte{lines[0], lines[1], lines[3]}, nil),
+		"swapped":         bytes.Join([][]byte{lines[0], lines[2], lines[1], lines[3]}, nil),
+		"truncated first": bytes.Join(lines[1:], nil),
+		"no hash":         append(append([]byte{}, content...), []byte("{\"event\":\"command\"}\n")...),
+	}
+	for name, content := range tampered {
+		_, err := VerifyAuditLog(bytes.NewReader(content))
+		assert.Error(t, err, name)
+	}
+
+	require.NoError(t, os.WriteFile(file, tampered["modified"], 0600))
+	assert.Error(t, (&AuditLog{File: file}).Open(), "a broken chain is not continued")
+}
+
+func TestServer_RefusesCommandNotAudited(t *testing.T) {
+	audit := &AuditLog{File: filepath.Join(t.TempDir(), "audit.log")}
+	require.NoError(t, audit.Open())
+	audit.file.Close() // writes fail from now on
+
+	store := NewStore()
+	server := &Server{Audit: audit}
+	require.NoError(t, server.InitStore(store))
+	commands := []*request{
+		{Command: "set_secret", Args: []string{"db"}, Payload: memguard.NewBufferFromBytes([]byte("s3cret"))},
+		{Command: "rotate_secret", Args: []string{"api"}, Payload: memguard.NewBufferFromBytes([]byte("s3cret"))},
+	}
+	for _, req := range commands {
+		resp := server.handleRequest(req, nil)
+		assert.NotEqual(t, StatusOK, resp.Status, req.Command)
+	}
+	assert.Empty(t, store.Names(), "commands not recorded do not run")
+}
+
+func TestAuditLog_NilRecordsNothing(t *testing.T) {
+	var audit *AuditLog
+	assert.NoError(t, audit.Record(AuditRecord{Event: AuditStart}))
+}
+
+func TestServer_AuditsConnectionsAndCommands(t *testing.T) {
+	pki := newTestPKI(t)
+	file := filepath.Join(pki.Dir, "audit.log")
+	audit := &AuditLog{File: file}
+	require.NoError(t, audit.Open())
+	defer audit.Close()
+
+	store := NewStore()
+	server := runTestServer(t, &Server{
+		SocketPath: filepath.Join(pki.Dir, "audit.sock"),
+		CertPem:    pki.ServerPem,
+		CertKey:    pki.ServerKey,
+		CAPem:      pki.CAPem,
+		Audit:      audit,
+	}, store)
+	client := newTestClient(t, pki, server)
+
+	secret := NewService()
+	setTestSecret(t, secret, "s3cret")
+	require.NoError(t, client.SetNamedSecret("db", secret))
+	require.NoError(t, client.GetNamedSecret("db", NewService()))
+	err := client.GetNamedSecret("missing", NewService())
+	assert.Equal(t, StatusNotSet, statusOf(err).Status)
+	client.Close()
+
+	records := readAuditRecords(t, file)
+	require.Len(t, records, 8)
+	connect := records[1]
+	assert.Equal(t, AuditConnect, connect.Event)
+	assert.Equal(t, "OK", connect.Outcome)
+	assert.Equal(t, "CN=client", connect.Subject)
+	assert.Len(t, connect.Fingerprint, 64)
+	assert.Len(t, connect.Spki, 64)
+	if connect.Peer != nil {
+		assert.Equal(t, int32(os.Getpid()), connect.Peer.Pid)
+	}
+
+	assert.Equal(t, AuditRequest, records[2].Event)
+	assert.Equal(t, "set_secret", records[2].Command)
+	assert.Equal(t, "db", records[2].Name)
+	assert.Equal(t, "", records[2].Outcome, "recorded before running")
+	assert.Equal(t, AuditCommand, records[3].Event)
+	assert.Equal(t, "set_secret", records[3].Command)
+	assert.Equal(t, "OK", records[3].Outcome)
+	assert.Equal(t, "get_secret", records[5].Command)
+	assert.Equal(t, "OK", records[5].Outcome)
+	assert.Equal(t, "missing", records[7].Name)
+	assert.Equal(t, "NOT_SET", records[7].Outcome)
+	assert.Equal(t, "CN=client", records[7].Subject)
+	for _, record := range records {
+		assert.NotContains(t, record.Message, "s3cret")
+	}
+}
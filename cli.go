@@ -1,24 +1,77 @@
 package memguarded
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
 	"github.com/oklog/run"
 )
 
 type CliConfig struct {
-	SocketPath     string
-	CertPassphrase *Service
-	Secret         *Service
-	ClientKey      string
-	ClientPem      string
-	ServerKey      string
-	ServerPem      string
-	CaPem          string
+	SocketPath           string
+	CertPassphrase       *Service
+	CertPassphraseSource SecretSource
+	Secret               *Service
+	SecretSource         SecretSource
+	Prompter             Prompter // asks secrets and passphrases without source, the terminal if nil
+	SecretName           string
+	TTL                  time.Duration
+	IdleTTL              time.Duration
+	Wait                 time.Duration
+	Version              uint64        // get this version instead of the current one
+	Grace                time.Duration // rotate keeps the previous version readable for this duration, server default if 0
+	JSON                 bool          // status prints the json report
+	ClientKey            string
+	ClientPem            string
+	ServerKey            string
+	ServerPem            string
+	CaPem                string
+	ServerCaPem          string
+	ServerPin            string
+	InsecureSkipVerify   bool // connects without ServerCaPem nor ServerPin
 
 	// server only
 	StopOnAnyClientError bool
+	MaxConnections       int
+	MaxWaiters           int
+	PolicyFile           string
+	DefaultTTL           time.Duration
+	MaxTTL               time.Duration
+	RotationGrace        time.Duration
+	AppVersion           string // reported by status
+	ReloadInterval       time.Duration
+	RevocationFile       string
+	SnapshotFile         string
+	SnapshotKeyFile      string
+	ShamirThreshold      int
+	AuditFile            string // also read by audit-verify
+	AuditSyslog          bool
+
+	// unseal only
+	SnapshotPassphraseSource SecretSource
+	SnapshotCreate           bool
+
+	// shares only
+	ShareSource      SecretSource
+	ShareCount       int
+	ShareOut         string
+	ShareGenerateKey bool
+
+	// pki only
+	PkiDir     string
+	CommonName string
+	CertName   string
+	ValidFor   time.Duration
+	KeyType    string
 }
 
 func StartServer(config CliConfig) error {
@@ -30,27 +83,82 @@ func StartServer(config CliConfig) error {
 	g.Add(sigterm.Start, sigterm.Stop)
 
 	// Cert passphrase
-	//config.CertPassphrase.Init()
-	//g.Add(config.CertPassphrase.Start, config.CertPassphrase.Stop)
+	config.CertPassphrase.Init()
+	g.Add(config.CertPassphrase.Start, config.CertPassphrase.Stop)
+	encrypted, err := isEncryptedKeyFile(config.ServerKey)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", config.ServerKey), "Failed to read server key")
+	}
+	if encrypted {
+		if err := config.readCertPassphrase(config.ServerPem, config.ServerKey); err != nil {
+			return err
+		}
+	}
 
-	// secret
+	// secrets
 	config.Secret.Init()
-	g.Add(config.Secret.Start, config.Secret.Stop)
+	if config.DefaultTTL > 0 && config.Secret.TTL() == 0 {
+		config.Secret.SetTTL(config.DefaultTTL)
+	}
+	store := NewStore()
+	store.Register(config.secretName(), config.Secret)
+	g.Add(store.Start, store.Stop)
+
+	// snapshot
+	var snapshot *Snapshot
+	if config.SnapshotFile != "" {
+		snapshot = &Snapshot{File: config.SnapshotFile, KeyFile: config.SnapshotKeyFile}
+		snapshot.Init(store)
+		g.Add(snapshot.Start, snapshot.Stop)
+	}
 
 	// socket
 	socketServer := Server{
 		CertKey:              config.ServerKey,
 		CertPem:              config.ServerPem,
 		CAPem:                config.CaPem,
+		CertPassphrase:       config.CertPassphrase,
 		SocketPath:           config.SocketPath,
 		StopOnAnyClientError: config.StopOnAnyClientError,
+		MaxConnections:       config.MaxConnections,
+		MaxWaiters:           config.MaxWaiters,
+		DefaultTTL:           config.DefaultTTL,
+		MaxTTL:               config.MaxTTL,
+		RotationGrace:        config.RotationGrace,
+		Version:              config.AppVersion,
+		ReloadInterval:       config.ReloadInterval,
+		RevocationFile:       config.RevocationFile,
+		Snapshot:             snapshot,
+		Shares:               config.shares(store, snapshot),
+	}
+
+	if config.AuditFile != "" || config.AuditSyslog {
+		audit := &AuditLog{File: config.AuditFile, Syslog: config.AuditSyslog}
+		if err := audit.Open(); err != nil {
+			return err
+		}
+		defer audit.Close()
+		socketServer.Audit = audit
 	}
 
-	if err := socketServer.Init(config.Secret); err != nil {
+	if config.PolicyFile != "" {
+		policy, err := LoadPolicy(config.PolicyFile)
+		if err != nil {
+			return err
+		}
+		socketServer.Policy = policy
+	}
+
+	if err := socketServer.InitStore(store); err != nil {
 		return err
 	}
 	g.Add(socketServer.Start, socketServer.Stop)
 
+	// certificates reload
+	sighup := SighupService{Reload: socketServer.Reload}
+	sighup.Init()
+	g.Add(sighup.Start, sighup.Stop)
+
 	// start services
 	if err := g.Run(); err != nil {
 		return err
@@ -60,25 +168,26 @@ func StartServer(config CliConfig) error {
 }
 
 func GetSecret(config CliConfig) error {
-	//cert passphrase
-	config.CertPassphrase.Init()
-	go config.CertPassphrase.Start()
-	defer config.CertPassphrase.Stop(nil)
-	if err := config.CertPassphrase.AskSecret(false, "Cert passphrase"); err != nil {
-		return errs.WithE(err, "Failed to ask passphrase")
+	client, err := connectClient(config)
+	if err != nil {
+		return err
 	}
+	defer client.Close()
 
-	client := Client{
-		CertPem:        config.ClientPem,
-		CertKey:        config.ClientKey,
-		SocketPath:     config.SocketPath,
-		CertPassphrase: config.CertPassphrase,
-	}
-	if err := client.Connect(); err != nil {
-		return err
+	if config.Wait > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), config.Wait)
+		defer cancel()
+		if err := client.WaitNamedSecret(ctx, config.secretName()); err != nil {
+			return errs.WithE(err, "Failed to wait for secret")
+		}
 	}
 
-	if err := client.GetSecret(config.Secret); err != nil {
+	if config.Version > 0 {
+		err = client.GetNamedSecretVersion(config.secretName(), config.Version, config.Secret)
+	} else {
+		err = client.GetNamedSecret(config.secretName(), config.Secret)
+	}
+	if err != nil {
 		return err
 	}
 
@@ -89,32 +198,460 @@ func GetSecret(config CliConfig) error {
 	return nil
 }
 
+func ListSecrets(config CliConfig) error {
+	client, err := connectClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	names, err := client.ListSecrets()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func ClearSecret(config CliConfig) error {
+	client, err := connectClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.ClearNamedSecret(config.secretName())
+}
+
+func DeleteSecret(config CliConfig) error {
+	client, err := connectClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.DeleteSecret(config.secretName())
+}
+
 func SetSecret(config CliConfig) error {
+	return config.sendSecret(func(client *Client) error {
+		return client.SetNamedSecret(config.secretName(), config.Secret)
+	})
+}
+
+// RotateSecret sets a new version of the secret, the previous one staying readable for the grace period
+func RotateSecret(config CliConfig) error {
+	return config.sendSecret(func(client *Client) error {
+		version, err := client.RotateNamedSecret(config.secretName(), config.Secret, config.Grace)
+		if err != nil {
+			return err
+		}
+		fmt.Println("version", version)
+		return nil
+	})
+}
+
+// SecretVersions prints the versions of the secret known by the server, without their values
+func SecretVersions(config CliConfig) error {
+	client, err := connectClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	versions, err := client.SecretVersions(config.secretName())
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		state := "forgotten"
+		switch {
+		case version.Current:
+			state = "current"
+		case version.Readable:
+			state = "readable until " + version.ReadableUntil.Format(time.RFC3339)
+		}
+		setter := version.Setter
+		if setter == "" {
+			setter = "-"
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\n", version.Version, version.SetAt.Format(time.RFC3339), setter, state)
+	}
+	return nil
+}
+
+// sendSecret reads the secret from its source, then sends it with send
+func (c CliConfig) sendSecret(send func(client *Client) error) error {
 	//cert passphrase
+	c.CertPassphrase.Init()
+	go c.CertPassphrase.Start()
+	defer c.CertPassphrase.Stop(nil)
+	if err := c.readCertPassphrase(c.ClientPem, c.ClientKey); err != nil {
+		return err
+	}
+
+	// secret
+	c.Secret.Init()
+	go c.Secret.Start()
+	defer c.Secret.Stop(nil)
+	if err := c.Secret.FromSource(c.SecretSource, "Secret", AskOptions{}); err != nil {
+		return errs.WithE(err, "Failed to get secret")
+	}
+	c.Secret.SetTTL(c.TTL)
+	c.Secret.SetIdleTTL(c.IdleTTL)
+
+	client := c.newClient()
+	if err := client.Connect(); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return send(client)
+}
+
+// Unseal sends the snapshot passphrase to the server, which restores the secrets of its snapshot
+func Unseal(config CliConfig) error {
+	client, err := connectClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	passphrase := NewService()
+	passphrase.Prompter = config.Prompter
+	defer passphrase.Clear()
+	options := AskOptions{}
+	if config.SnapshotCreate {
+		options = AskOptions{Confirmation: true, MinLength: minPassphraseLength}
+	}
+	if err := passphrase.FromSource(config.SnapshotPassphraseSource, "Snapshot passphrase", options); err != nil {
+		return errs.WithE(err, "Failed to get snapshot passphrase")
+	}
+
+	restored, err := client.Unseal(passphrase, config.SnapshotCreate)
+	if err != nil {
+		return err
+	}
+	fmt.Println(restored)
+	return nil
+}
+
+// SplitShares splits the secret, or a new snapshot key, in share files written as <out>.<n>.share
+func SplitShares(config CliConfig) error {
+	if config.ShareOut == "" {
+		return errs.With("Output of the shares is required")
+	}
+
+	var secret *memguard.LockedBuffer
+	if config.ShareGenerateKey {
+		secret = memguard.NewBufferRandom(32)
+	} else {
+		config.Secret.Init()
+		if err := config.Secret.FromSource(config.SecretSource, "Secret", AskOptions{Confirmation: true}); err != nil {
+			return errs.WithE(err, "Failed to get secret to split")
+		}
+		defer config.Secret.Clear()
+		var err error
+		if secret, err = config.Secret.Get(); err != nil {
+			return err
+		}
+	}
+	defer secret.Destroy()
+
+	shares, err := SplitSecret(secret.Bytes(), config.ShareCount, config.ShamirThreshold)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, share := range shares {
+			share.Destroy()
+		}
+	}()
+	for i, share := range shares {
+		file := config.ShareOut + "." + strconv.Itoa(i+1) + ".share"
+		encoded := hexBuffer(share)
+		err := writeNewFile(file, encoded.Bytes(), 0600)
+		encoded.Destroy()
+		if err != nil {
+			return err
+		}
+		fmt.Println(file)
+	}
+	return nil
+}
+
+// SubmitShare sends a share to the server, which rebuilds its secret once it has enough
+func SubmitShare(config CliConfig) error {
+	client, err := connectClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	encoded := NewService()
+	encoded.Prompter = config.Prompter
+	if err := encoded.FromSource(config.ShareSource, "Share", AskOptions{}); err != nil {
+		return errs.WithE(err, "Failed to get share")
+	}
+	buffer, err := encoded.Get()
+	encoded.Clear()
+	if err != nil {
+		return err
+	}
+	decoded, err := unhexBuffer(buffer)
+	buffer.Destroy()
+	if err != nil {
+		return err
+	}
+	share := NewService()
+	share.setAndNotify(decoded)
+	defer share.Clear()
+
+	received, threshold, err := client.SubmitShare(share)
+	if err != nil {
+		return err
+	}
+	if received == 0 {
+		fmt.Println("unsealed")
+		return nil
+	}
+	fmt.Printf("%d/%d\n", received, threshold)
+	return nil
+}
+
+func ServerStatus(config CliConfig) error {
+	client, err := connectClient(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	report, err := client.Status()
+	if err != nil {
+		return err
+	}
+	if config.JSON {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+
+	fmt.Println("version:", report.Version)
+	fmt.Println("protocol:", report.Protocol)
+	fmt.Println("uptime:", time.Duration(report.UptimeSeconds)*time.Second)
+	if report.Sealed != nil {
+		fmt.Println("sealed:", *report.Sealed)
+	}
+	if report.Shares != nil {
+		fmt.Printf("shares: %d/%d\n", report.Shares.Received, report.Shares.Threshold)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSET\tSIZE\tVERSION\tGETS\tSET AT\tLAST ACCESS\tEXPIRES IN")
+	for _, secret := range report.Secrets {
+		expiresIn := "-"
+		if !secret.ExpiresAt.IsZero() {
+			expiresIn = (time.Duration(secret.TTLRemainingSeconds) * time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%t\t%d\t%d\t%d\t%s\t%s\t%s\n", secret.Name, secret.Set, secret.Size, secret.Version,
+			secret.Gets, formatTime(secret.SetAt), formatTime(secret.LastAccess), expiresIn)
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// VerifyAudit checks the hash chain of the audit log file
+func VerifyAudit(config CliConfig) error {
+	file, err := os.Open(config.AuditFile)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", config.AuditFile), "Failed to open audit log")
+	}
+	defer file.Close()
+
+	count, err := VerifyAuditLog(file)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", config.AuditFile).WithField("verified", count), "Audit log is not valid")
+	}
+	fmt.Println(count, "records verified")
+	return nil
+}
+
+func connectClient(config CliConfig) (*Client, error) {
 	config.CertPassphrase.Init()
 	go config.CertPassphrase.Start()
 	defer config.CertPassphrase.Stop(nil)
-	if err := config.CertPassphrase.AskSecret(false, "Cert passphrase"); err != nil {
-		return errs.WithE(err, "Failed to ask passphrase")
+	if err := config.readCertPassphrase(config.ClientPem, config.ClientKey); err != nil {
+		return nil, err
 	}
 
-	// secret
-	config.Secret.Init()
-	go config.Secret.Start()
-	defer config.Secret.Stop(nil)
-	if err := config.Secret.AskSecret(false, "Secret"); err != nil {
-		return errs.WithE(err, "Failed to ask secret")
+	client := config.newClient()
+	if err := client.Connect(); err != nil {
+		return nil, err
 	}
+	return client, nil
+}
 
-	client := Client{
-		CertPem:        config.ClientPem,
-		CertKey:        config.ClientKey,
-		SocketPath:     config.SocketPath,
-		CertPassphrase: config.CertPassphrase,
+// readCertPassphrase reads the cert passphrase from its source, or asks it until it decrypts keyFile
+func (c CliConfig) readCertPassphrase(certFile, keyFile string) error {
+	if err := c.CertPassphrase.FromSource(c.CertPassphraseSource, "Cert passphrase", decryptOptions(certFile, keyFile)); err != nil {
+		return errs.WithE(err, "Failed to get cert passphrase")
 	}
-	if err := client.Connect(); err != nil {
+	return nil
+}
+
+// decryptOptions refuses a passphrase that does not decrypt keyFile, when it is encrypted
+func decryptOptions(certFile, keyFile string) AskOptions {
+	if encrypted, err := isEncryptedKeyFile(keyFile); err != nil || !encrypted {
+		return AskOptions{}
+	}
+	return AskOptions{Validate: func(secret *memguard.LockedBuffer) error {
+		passphrase := NewService()
+		defer passphrase.Clear()
+		copied := memguard.NewBuffer(secret.Size())
+		copied.Copy(secret.Bytes())
+		passphrase.setAndNotify(copied)
+
+		if _, err := loadX509KeyPair(certFile, keyFile, passphrase); err != nil {
+			logs.WithE(err).WithField("file", keyFile).Debug("Passphrase refused")
+			return errs.With("Passphrase does not decrypt the private key")
+		}
+		return nil
+	}}
+}
+
+// shares collects the shares unsealing the snapshot, or setting the secret without snapshot
+func (c CliConfig) shares(store *Store, snapshot *Snapshot) *Shares {
+	if c.ShamirThreshold <= 0 {
+		return nil
+	}
+	shares := &Shares{Threshold: c.ShamirThreshold}
+	if snapshot != nil {
+		shares.Unseal = func(key *memguard.LockedBuffer) error {
+			_, err := snapshot.unseal(key, snapshotKdfKey, true)
+			return err
+		}
+		return shares
+	}
+	shares.Unseal = func(secret *memguard.LockedBuffer) error {
+		copied := memguard.NewBuffer(secret.Size())
+		copied.Copy(secret.Bytes())
+		store.Service(c.secretName()).setAndNotify(copied)
+		return nil
+	}
+	return shares
+}
+
+func (c CliConfig) newClient() *Client {
+	return &Client{
+		CertPem:        c.ClientPem,
+		CertKey:        c.ClientKey,
+		CAPem:          c.ServerCaPem,
+		ServerPin:      c.ServerPin,
+		Insecure:       c.InsecureSkipVerify,
+		SocketPath:     c.SocketPath,
+		CertPassphrase: c.CertPassphrase,
+	}
+}
+
+func (c CliConfig) secretName() string {
+	if c.SecretName == "" {
+		return DefaultSecretName
+	}
+	return c.SecretName
+}
+
+// minPassphraseLength is required for the passphrases of the keys created by the pki commands
+const minPassphraseLength = 8
+
+func PkiInit(config CliConfig) error {
+	caPassphrase, err := config.askPassphrase("CA passphrase", AskOptions{Confirmation: true, MinLength: minPassphraseLength})
+	if err != nil {
+		return err
+	}
+	defer caPassphrase.Stop(nil)
+
+	return config.pki().Init(caPassphrase, config.commonName("memguarded CA"))
+}
+
+func PkiIssueClient(config CliConfig) error {
+	caPassphrase, err := config.askPassphrase("CA passphrase", config.caDecryptOptions())
+	if err != nil {
+		return err
+	}
+	defer caPassphrase.Stop(nil)
+
+	keyPassphrase, err := config.askPassphrase("Cert passphrase", AskOptions{Confirmation: true, MinLength: minPassphraseLength})
+	if err != nil {
+		return err
+	}
+	defer keyPassphrase.Stop(nil)
+
+	return config.pki().IssueClient(caPassphrase, keyPassphrase, config.certName("client"), config.commonName("memguarded client"))
+}
+
+func PkiIssueServer(config CliConfig) error {
+	caPassphrase, err := config.askPassphrase("CA passphrase", config.caDecryptOptions())
+	if err != nil {
+		return err
+	}
+	defer caPassphrase.Stop(nil)
+
+	keyPassphrase, err := config.askPassphrase("Cert passphrase", AskOptions{Confirmation: true, MinLength: minPassphraseLength})
+	if err != nil {
+		return err
+	}
+	defer keyPassphrase.Stop(nil)
+
+	return config.pki().IssueServer(caPassphrase, keyPassphrase, config.certName("server"), config.commonName("memguarded server"))
+}
+
+func PkiRevoke(config CliConfig) error {
+	if config.CertName == "" {
+		return errs.With("Name of the certificate to revoke is required")
+	}
+	pki := config.pki()
+	if err := pki.Revoke(config.CertName); err != nil {
 		return err
 	}
+	fmt.Println(pki.RevocationFile())
+	return nil
+}
 
-	return client.SetSecret(config.Secret)
+func (c CliConfig) askPassphrase(name string, options AskOptions) (*Service, error) {
+	passphrase := NewService()
+	passphrase.Prompter = c.Prompter
+	go passphrase.Start()
+	if err := passphrase.AskSecretWithOptions(name, options); err != nil {
+		passphrase.Stop(nil)
+		return nil, errs.WithE(err, "Failed to ask passphrase")
+	}
+	return passphrase, nil
+}
+
+func (c CliConfig) caDecryptOptions() AskOptions {
+	pki := c.pki()
+	return decryptOptions(pki.Path(pkiCA, ".pem"), pki.Path(pkiCA, ".key"))
+}
+
+func (c CliConfig) pki() *PKI {
+	return &PKI{Dir: c.PkiDir, ValidFor: c.ValidFor, KeyType: c.KeyType}
+}
+
+func (c CliConfig) commonName(defaultName string) string {
+	if c.CommonName == "" {
+		return defaultName
+	}
+	return c.CommonName
+}
+
+func (c CliConfig) certName(defaultName string) string {
+	if c.CertName == "" {
+		return defaultName
+	}
+	return c.CertName
 }
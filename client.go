@@ -1,12 +1,19 @@
 package memguarded
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"log"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/awnumar/memguard"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
@@ -17,8 +24,16 @@ type Client struct {
 	CertPassphrase *Service
 	CertKey        string
 	CertPem        string
+	// CAPem verifies the server certificate chain, Connect fails if empty and ServerPin too, unless Insecure
+	CAPem string
+	// ServerPin is the hex encoded sha256 of the server certificate public key, checked if set
+	ServerPin string
+	// Insecure connects to a server that cannot be verified, without CAPem nor ServerPin
+	Insecure bool
 
-	conn net.Conn
+	conn         net.Conn
+	version      int
+	capabilities []string
 }
 
 func (c *Client) Connect() error {
@@ -27,7 +42,29 @@ func (c *Client) Connect() error {
 		return errs.WithE(err, "Failed to load key pair")
 	}
 
-	config := tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
+	var roots *x509.CertPool
+	if c.CAPem != "" {
+		pem, err := os.ReadFile(c.CAPem)
+		if err != nil {
+			return errs.WithEF(err, data.WithField("file", c.CAPem), "Failed to read server certificate authority")
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return errs.WithF(data.WithField("file", c.CAPem), "Failed to parse server certificate authority")
+		}
+	} else if c.ServerPin == "" {
+		if !c.Insecure {
+			return errs.WithF(data.WithField("socketPath", c.SocketPath), "No CA nor pin configured to verify the server certificate")
+		}
+		logs.WithF(data.WithField("socketPath", c.SocketPath)).Warn("Server certificate is not verified, no CA nor pin configured")
+	}
+
+	// there is no hostname on a unix socket, the chain and pin are checked by verifyServer instead
+	config := tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		VerifyConnection:   c.verifyServer(roots),
+	}
 
 	conn, err := tls.Dial("unix", c.SocketPath, &config)
 	if err != nil {
@@ -50,9 +87,46 @@ func (c *Client) Connect() error {
 		return errs.WithE(err, "Failed to set deadline")
 	}
 
+	c.version, c.capabilities, err = clientHandshake(conn)
+	if err != nil {
+		c.Close()
+		return errs.WithE(err, "Protocol handshake failed")
+	}
+	logs.WithF(data.WithField("version", c.version)).Debug("Protocol negotiated")
+
 	return nil
 }
 
+func (c *Client) verifyServer(roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errs.With("Server sent no certificate")
+		}
+		leaf := state.PeerCertificates[0]
+
+		if roots != nil {
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			if _, err := leaf.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}); err != nil {
+				return errs.WithEF(err, data.WithField("subject", leaf.Subject.String()), "Server certificate verification failed")
+			}
+		}
+
+		if c.ServerPin != "" {
+			if fingerprint := spkiSha256(leaf); !strings.EqualFold(fingerprint, c.ServerPin) {
+				return errs.WithF(data.WithField("expected", c.ServerPin).WithField("got", fingerprint), "Server public key does not match pin")
+			}
+		}
+		return nil
+	}
+}
+
 func (c *Client) Close() {
 	if c.conn != nil {
 		c.conn.Close()
@@ -60,35 +134,247 @@ func (c *Client) Close() {
 	}
 }
 
+// Capabilities returns the commands supported by the server
+func (c *Client) Capabilities() []string {
+	return c.capabilities
+}
+
 func (c *Client) SetSecret(secretService *Service) error {
-	if c.conn == nil {
-		return errs.With("Not connected")
+	return c.SetNamedSecret(DefaultSecretName, secretService)
+}
+
+// SetNamedSecret sends the secret with the ttl and idle ttl of secretService, if any
+func (c *Client) SetNamedSecret(name string, secretService *Service) error {
+	buffer, err := secretService.Get()
+	if err != nil {
+		return errs.WithE(err, "Failed to open secret")
 	}
+	defer buffer.Destroy()
 
-	if err := WriteBytes(c.conn, []byte("set_secret ")); err != nil {
-		return errs.WithE(err, "Failed to write command")
+	args := []string{name}
+	if ttl := secretService.TTL(); ttl > 0 {
+		args = append(args, "ttl="+ttl.String())
+	}
+	if idleTTL := secretService.IdleTTL(); idleTTL > 0 {
+		args = append(args, "idle-ttl="+idleTTL.String())
 	}
 
-	if err := secretService.Write(c.conn); err != nil {
-		return errs.WithE(err, "Failed to write key")
+	_, _, err = c.call("set_secret", args, buffer)
+	return err
+}
+
+func (c *Client) GetSecret(secretService *Service) error {
+	return c.GetNamedSecret(DefaultSecretName, secretService)
+}
+
+func (c *Client) GetNamedSecret(name string, secretService *Service) error {
+	_, payload, err := c.call("get_secret", []string{name}, nil)
+	if err != nil {
+		return err
 	}
+	secretService.setAndNotify(payload)
+	return nil
+}
 
-	if err := WriteBytes(c.conn, []byte{'\n'}); err != nil {
+// GetNamedSecretVersion gets the current version of the secret, or a previous one still in its rotation grace period
+func (c *Client) GetNamedSecretVersion(name string, version uint64, secretService *Service) error {
+	_, payload, err := c.call("get_secret", []string{name, "version=" + strconv.FormatUint(version, 10)}, nil)
+	if err != nil {
 		return err
 	}
+	secretService.setAndNotify(payload)
 	return nil
 }
 
-func (c *Client) GetSecret(secretService *Service) error {
+// RotateNamedSecret promotes the secret of secretService, the previous version staying readable for grace.
+// A grace of 0 uses the default of the server. It returns the new version number.
+func (c *Client) RotateNamedSecret(name string, secretService *Service, grace time.Duration) (uint64, error) {
+	buffer, err := secretService.Get()
+	if err != nil {
+		return 0, errs.WithE(err, "Failed to open secret")
+	}
+	defer buffer.Destroy()
+
+	args := []string{name}
+	if grace > 0 {
+		args = append(args, "grace="+grace.String())
+	}
+	if ttl := secretService.TTL(); ttl > 0 {
+		args = append(args, "ttl="+ttl.String())
+	}
+	if idleTTL := secretService.IdleTTL(); idleTTL > 0 {
+		args = append(args, "idle-ttl="+idleTTL.String())
+	}
+	values, _, err := c.call("rotate_secret", args, buffer)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) != 1 {
+		return 0, errs.With("Invalid rotate response")
+	}
+	return strconv.ParseUint(values[0], 10, 64)
+}
+
+// SecretVersions returns the metadata of the versions of the secret known by the server, oldest first
+func (c *Client) SecretVersions(name string) ([]VersionInfo, error) {
+	values, _, err := c.call("secret_versions", []string{name}, nil)
+	if err != nil {
+		return nil, err
+	}
+	versions := []VersionInfo{}
+	for _, value := range values {
+		var version VersionInfo
+		if err := json.Unmarshal([]byte(value), &version); err != nil {
+			return nil, errs.WithEF(err, data.WithField("value", value), "Invalid version in response")
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// WaitSecret blocks until the default secret is set on the server
+func (c *Client) WaitSecret(ctx context.Context) error {
+	return c.WaitNamedSecret(ctx, DefaultSecretName)
+}
+
+// WaitNamedSecret blocks until the secret is set on the server, ErrSecretNotSet is returned when ctx deadline is reached first
+func (c *Client) WaitNamedSecret(ctx context.Context, name string) error {
 	if c.conn == nil {
 		return errs.With("Not connected")
 	}
-	if err := WriteBytes(c.conn, []byte("get_secret\n")); err != nil {
-		return errs.WithE(err, "Failed to write command")
+
+	args := []string{name}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return ctx.Err()
+		}
+		args = append(args, "timeout="+timeout.String())
+		if err := c.conn.SetDeadline(deadline.Add(10 * time.Second)); err != nil {
+			return errs.WithE(err, "Failed to set deadline")
+		}
+	} else if err := c.conn.SetDeadline(time.Time{}); err != nil {
+		return errs.WithE(err, "Failed to set deadline")
 	}
+	defer func() {
+		if c.conn != nil {
+			c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+		}
+	}()
+
+	// unblock the read when ctx is canceled, on deadline the server replies by itself
+	conn := c.conn
+	stop := context.AfterFunc(ctx, func() {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			conn.SetDeadline(time.Now())
+		}
+	})
+	defer stop()
 
-	if err := secretService.FromReaderUntilNewLine(c.conn); err != nil {
-		return errs.WithE(err, "Failed to get secret")
+	_, _, err := c.call("wait_secret", args, nil)
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) && !errors.Is(err, ErrSecretNotSet) {
+		// the response may still come, the connection cannot be reused
+		c.Close()
+		return ctx.Err()
 	}
-	return nil
+	return err
+}
+
+func (c *Client) ListSecrets() ([]string, error) {
+	names, _, err := c.call("list_secrets", nil, nil)
+	return names, err
+}
+
+func (c *Client) ClearSecret() error {
+	return c.ClearNamedSecret(DefaultSecretName)
+}
+
+// ClearNamedSecret destroys the secret on the server, keeping its name and watchers
+func (c *Client) ClearNamedSecret(name string) error {
+	_, _, err := c.call("clear_secret", []string{name}, nil)
+	return err
+}
+
+func (c *Client) DeleteSecret(name string) error {
+	_, _, err := c.call("delete_secret", []string{name}, nil)
+	return err
+}
+
+// Unseal sends the snapshot passphrase to the server and returns the number of secrets restored.
+// With create, the server starts a new snapshot if it has none.
+func (c *Client) Unseal(passphrase *Service, create bool) (int, error) {
+	buffer, err := passphrase.Get()
+	if err != nil {
+		return 0, errs.WithE(err, "Failed to open passphrase")
+	}
+	defer buffer.Destroy()
+
+	args := []string{}
+	if create {
+		args = append(args, "create=true")
+	}
+	values, _, err := c.call("unseal", args, buffer)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) != 1 {
+		return 0, errs.With("Invalid unseal response")
+	}
+	return strconv.Atoi(values[0])
+}
+
+// SubmitShare sends a share of the secret split on the server, returns the number of shares received and needed.
+// Once enough shares are received, the server rebuilds the secret and received is 0.
+func (c *Client) SubmitShare(share *Service) (int, int, error) {
+	buffer, err := share.Get()
+	if err != nil {
+		return 0, 0, errs.WithE(err, "Failed to open share")
+	}
+	defer buffer.Destroy()
+
+	values, _, err := c.call("submit_share", nil, buffer)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(values) != 2 {
+		return 0, 0, errs.With("Invalid submit share response")
+	}
+	received, err := strconv.Atoi(values[0])
+	if err != nil {
+		return 0, 0, errs.WithE(err, "Invalid submit share response")
+	}
+	threshold, err := strconv.Atoi(values[1])
+	if err != nil {
+		return 0, 0, errs.WithE(err, "Invalid submit share response")
+	}
+	return received, threshold, nil
+}
+
+// Status returns the state of the server and the metadata of its secrets
+func (c *Client) Status() (*StatusReport, error) {
+	_, payload, err := c.call("status", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if payload == nil {
+		return nil, errs.With("Invalid status response")
+	}
+	defer payload.Destroy()
+	report := &StatusReport{}
+	if err := json.Unmarshal(payload.Bytes(), report); err != nil {
+		return nil, errs.WithE(err, "Invalid status in response")
+	}
+	return report, nil
+}
+
+// call sends a command and reads its response, a non OK status is returned unwrapped as a *StatusError
+func (c *Client) call(command string, args []string, payload *memguard.LockedBuffer) ([]string, *memguard.LockedBuffer, error) {
+	if c.conn == nil {
+		return nil, nil, errs.With("Not connected")
+	}
+
+	if err := writeRequest(c.conn, command, args, payload); err != nil {
+		return nil, nil, errs.WithEF(err, data.WithField("command", command), "Failed to write command")
+	}
+	return readResponse(c.conn)
 }
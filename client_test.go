@@ -0,0 +1,87 @@
+package memguarded
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_VerifiesServerAgainstCA(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	server := startTestServer(t, pki, NewStore())
+
+	client := testClient(pki, server)
+	client.CAPem = pki.CAPem
+	require.NoError(t, client.Connect())
+	client.Close()
+
+	other := newTestPKI(t)
+	client = testClient(pki, server)
+	client.CAPem = other.CAPem
+	err := client.Connect()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Server certificate verification failed")
+}
+
+func TestClient_RefusesUnverifiedServer(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	server := startTestServer(t, pki, NewStore())
+
+	client := testClient(pki, server)
+	client.CAPem = ""
+	err := client.Connect()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "No CA nor pin configured")
+
+	client.Insecure = true
+	require.NoError(t, client.Connect())
+	client.Close()
+}
+
+func TestClient_RejectsClientCertificateAsServer(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	// a server using a client only certificate of the right CA
+	server := runTestServer(t, &Server{
+		SocketPath: filepath.Join(pki.Dir, "test.sock"),
+		CertPem:    pki.ClientPem,
+		CertKey:    pki.ClientKey,
+		CAPem:      pki.CAPem,
+	}, NewStore())
+
+	client := testClient(pki, server)
+	client.CAPem = pki.CAPem
+	assert.Error(t, client.Connect())
+}
+
+func TestClient_ServerPin(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	server := startTestServer(t, pki, NewStore())
+	serverCert, err := loadX509KeyPair(pki.ServerPem, pki.ServerKey, nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	require.NoError(t, err)
+
+	client := testClient(pki, server)
+	client.ServerPin = strings.ToUpper(spkiSha256(leaf))
+	require.NoError(t, client.Connect())
+	client.Close()
+
+	client = testClient(pki, server)
+	client.ServerPin = strings.Repeat("00", 32)
+	err = client.Connect()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Server public key does not match pin")
+}
@@ -0,0 +1,87 @@
+package memguarded
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type EventKind int
+
+const (
+	EventSet EventKind = iota
+	EventCleared
+	EventExpired
+	EventRotated
+)
+
+var eventKindNames = map[EventKind]string{
+	EventSet:     "set",
+	EventCleared: "cleared",
+	EventExpired: "expired",
+	EventRotated: "rotated",
+}
+
+func (k EventKind) String() string {
+	if name, ok := eventKindNames[k]; ok {
+		return name
+	}
+	return "event_" + strconv.Itoa(int(k))
+}
+
+// Event describes a change of a secret, it never carries the secret itself
+type Event struct {
+	Kind EventKind
+	Name string
+	Time time.Time
+}
+
+// Subscription receives the events of a Service until its context is done.
+// Events are delivered without blocking the service, when the buffer is full they are dropped and counted.
+type Subscription struct {
+	events  chan Event
+	dropped uint64
+}
+
+// Events is closed once the subscription context is done
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events lost because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) deliver(event Event) {
+	select {
+	case s.events <- event:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Subscribe returns a subscription with room for buffer pending events, removed when ctx is done
+func (s *Service) Subscribe(ctx context.Context, buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	sub := &Subscription{events: make(chan Event, buffer)}
+
+	s.notifyLock.Lock()
+	if s.subscriptions == nil {
+		s.subscriptions = make(map[*Subscription]struct{})
+	}
+	s.subscriptions[sub] = struct{}{}
+	s.notifyLock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.notifyLock.Lock()
+		delete(s.subscriptions, sub)
+		s.notifyLock.Unlock()
+		close(sub.events)
+	}()
+	return sub
+}
@@ -0,0 +1,91 @@
+package memguarded
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+)
+
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	select {
+	case event := <-sub.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("did not receive event")
+	}
+	return Event{}
+}
+
+func TestSubscribe_EventKinds(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	store := NewStore()
+	svc := store.Service("db")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := svc.Subscribe(ctx, 10)
+
+	b := []byte("value")
+	assert.NoError(t, svc.FromBytes(&b))
+	event := nextEvent(t, sub)
+	assert.Equal(t, EventSet, event.Kind)
+	assert.Equal(t, "db", event.Name)
+	assert.False(t, event.Time.IsZero())
+
+	svc.Clear()
+	assert.Equal(t, EventCleared, nextEvent(t, sub).Kind)
+
+	svc.SetTTL(10 * time.Millisecond)
+	c := []byte("value")
+	assert.NoError(t, svc.FromBytes(&c))
+	assert.Equal(t, EventSet, nextEvent(t, sub).Kind)
+	assert.Equal(t, EventExpired, nextEvent(t, sub).Kind)
+}
+
+func TestSubscribe_SlowSubscriberDropsWithoutBlocking(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	svc := NewService()
+	sub := svc.Subscribe(context.Background(), 2)
+	watch := svc.Watch()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			b := []byte("value")
+			_ = svc.FromBytes(&b)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("set blocked on subscribers not reading")
+	}
+	assert.Equal(t, uint64(3), sub.Dropped())
+	assert.Len(t, watch, 1)
+}
+
+func TestSubscribe_ContextCancelCloses(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	svc := NewService()
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := svc.Subscribe(ctx, 1)
+	cancel()
+
+	select {
+	case _, ok := <-sub.Events():
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatalf("subscription not closed")
+	}
+
+	b := []byte("value")
+	assert.NoError(t, svc.FromBytes(&b))
+	assert.Equal(t, uint64(0), sub.Dropped())
+}
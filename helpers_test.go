@@ -0,0 +1,144 @@
+package memguarded
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPKI is a throwaway CA with a server and a client certificate written in a temp dir
+type testPKI struct {
+	Dir       string
+	CAPem     string
+	ServerPem string
+	ServerKey string
+	ClientPem string
+	ClientKey string
+
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir := t.TempDir()
+	p := &testPKI{
+		Dir:       dir,
+		CAPem:     filepath.Join(dir, "ca.pem"),
+		ServerPem: filepath.Join(dir, "server.pem"),
+		ServerKey: filepath.Join(dir, "server.key"),
+		ClientPem: filepath.Join(dir, "client.pem"),
+		ClientKey: filepath.Join(dir, "client.key"),
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	p.caCert, err = x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	p.caKey = caKey
+	writeTestPem(t, p.CAPem, "CERTIFICATE", caDER)
+
+	p.issue(t, p.ServerPem, p.ServerKey, "server", x509.ExtKeyUsageServerAuth)
+	p.issue(t, p.ClientPem, p.ClientKey, "client", x509.ExtKeyUsageClientAuth)
+	return p
+}
+
+func (p *testPKI) issue(t *testing.T, pemPath, keyPath, commonName string, usage x509.ExtKeyUsage) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.caCert, key.Public(), p.caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	writeTestPem(t, pemPath, "CERTIFICATE", der)
+	writeTestPem(t, keyPath, "PRIVATE KEY", keyDER)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func writeTestPem(t *testing.T, path string, blockType string, der []byte) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+// startTestServer runs a server on a socket of the pki dir until the end of the test
+func startTestServer(t *testing.T, p *testPKI, store *Store) *Server {
+	return runTestServer(t, &Server{
+		SocketPath: filepath.Join(p.Dir, "test.sock"),
+		CertPem:    p.ServerPem,
+		CertKey:    p.ServerKey,
+		CAPem:      p.CAPem,
+	}, store)
+}
+
+// runTestServer starts an already configured server until the end of the test
+func runTestServer(t *testing.T, server *Server, store *Store) *Server {
+	require.NoError(t, server.InitStore(store))
+
+	done := make(chan error, 1)
+	go func() { done <- server.Start() }()
+	t.Cleanup(func() {
+		server.Stop(nil)
+		require.NoError(t, <-done)
+	})
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		stat, err := os.Stat(server.SocketPath)
+		if err == nil && stat.Mode() == os.ModeSocket|0700 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "server socket not ready")
+	}
+	return server
+}
+
+// testClient returns a client of the pki, not connected
+func testClient(p *testPKI, server *Server) *Client {
+	return &Client{
+		SocketPath:     server.SocketPath,
+		CertPem:        p.ClientPem,
+		CertKey:        p.ClientKey,
+		CAPem:          p.CAPem,
+		CertPassphrase: NewService(),
+	}
+}
+
+func newTestClient(t *testing.T, p *testPKI, server *Server) *Client {
+	client := testClient(p, server)
+	require.NoError(t, client.Connect())
+	t.Cleanup(client.Close)
+	return client
+}
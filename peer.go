@@ -0,0 +1,59 @@
+package memguarded
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// PeerInfo describes the process on the other side of the socket, from SO_PEERCRED and /proc
+type PeerInfo struct {
+	Uid     uint32
+	Gid     uint32
+	Pid     int32
+	Groups  []uint32
+	Exe     string
+	Cgroups []string
+
+	exeSha256     string
+	exeSha256Err  error
+	exeSha256Once sync.Once
+}
+
+// ExeSha256 hashes the executable of the peer, through /proc so a replaced file is not hashed instead
+func (p *PeerInfo) ExeSha256() (string, error) {
+	p.exeSha256Once.Do(func() {
+		file, err := os.Open("/proc/" + strconv.Itoa(int(p.Pid)) + "/exe")
+		if err != nil {
+			p.exeSha256Err = errs.WithEF(err, data.WithField("pid", p.Pid), "Failed to open peer executable")
+			return
+		}
+		defer file.Close()
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			p.exeSha256Err = errs.WithEF(err, data.WithField("pid", p.Pid), "Failed to hash peer executable")
+			return
+		}
+		p.exeSha256 = hex.EncodeToString(hash.Sum(nil))
+	})
+	return p.exeSha256, p.exeSha256Err
+}
+
+func (p *PeerInfo) fields() data.Fields {
+	if p == nil {
+		return data.WithField("peer", "unknown")
+	}
+	return data.WithField("uid", p.Uid).
+		WithField("gid", p.Gid).
+		WithField("pid", p.Pid).
+		WithField("groups", p.Groups).
+		WithField("exe", p.Exe).
+		WithField("cgroups", p.Cgroups)
+}
@@ -0,0 +1,275 @@
+package memguarded
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// assuanCancelled is the error code of pinentry when the user cancels
+const assuanCancelled = "83886179"
+
+const assuanMaxLine = 1000
+
+// PinentryPrompter asks the secret through an external pinentry program, speaking the Assuan protocol.
+// The pin is read from the pipe directly into memguard.
+type PinentryPrompter struct {
+	Path        string // pinentry in PATH if empty
+	Title       string
+	Description string // the description of the request if empty
+}
+
+// Prompt runs a pinentry session for each attempt, the confirmation is asked in the same session
+func (p *PinentryPrompter) Prompt(request PromptRequest) (*memguard.LockedBuffer, error) {
+	path := p.Path
+	if path == "" {
+		path = "pinentry"
+	}
+
+	cmd := exec.Command(path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to open pinentry stdin")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to open pinentry stdout")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errs.WithEF(err, data.WithField("path", path), "Failed to start pinentry")
+	}
+
+	conn := &assuanConn{w: stdin, r: stdout}
+	defer func() {
+		_ = conn.command("BYE")
+		stdin.Close()
+		_ = cmd.Wait()
+	}()
+
+	if _, err := conn.response(); err != nil {
+		return nil, errs.WithE(err, "Pinentry did not greet")
+	}
+
+	description := p.Description
+	if description == "" {
+		description = request.Description
+	}
+	setup := [][]string{}
+	if description != "" {
+		setup = append(setup, []string{"SETDESC", description})
+	}
+	setup = append(setup, []string{"SETPROMPT", request.Prompt + ":"})
+	if p.Title != "" {
+		setup = append(setup, []string{"SETTITLE", p.Title})
+	}
+	if request.Error != "" {
+		setup = append(setup, []string{"SETERROR", request.Error})
+	}
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		setup = append(setup, []string{"OPTION", "ttyname=" + tty})
+	}
+	for _, command := range setup {
+		if err := conn.command(command...); err != nil {
+			return nil, err
+		}
+	}
+
+	pin, err := conn.getPin()
+	if err != nil || request.Confirm == "" {
+		return pin, err
+	}
+	if err := conn.command("SETPROMPT", request.Confirm+":"); err != nil {
+		destroyBuffer(pin)
+		return nil, err
+	}
+	confirm, err := conn.getPin()
+	if err != nil {
+		destroyBuffer(pin)
+		return nil, err
+	}
+	return confirmed(pin, confirm)
+}
+
+/////////////////////
+
+// assuanConn reads responses a byte at a time, so data lines go to memguard without buffering
+type assuanConn struct {
+	w io.Writer
+	r io.Reader
+}
+
+// command sends the command with its percent escaped arguments and discards any data of the response
+func (c *assuanConn) command(command ...string) error {
+	buffer, err := c.request(command...)
+	destroyBuffer(buffer)
+	return err
+}
+
+// getPin returns nil when the pin is empty
+func (c *assuanConn) getPin() (*memguard.LockedBuffer, error) {
+	return c.request("GETPIN")
+}
+
+func (c *assuanConn) request(command ...string) (*memguard.LockedBuffer, error) {
+	line := command[0]
+	for _, arg := range command[1:] {
+		line += " " + assuanEscape(arg)
+	}
+	if _, err := io.WriteString(c.w, line+"\n"); err != nil {
+		return nil, errs.WithEF(err, data.WithField("command", command[0]), "Failed to write to pinentry")
+	}
+	buffer, err := c.response()
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("command", command[0]), "Pinentry command failed")
+	}
+	return buffer, nil
+}
+
+// response reads lines until OK or ERR, returning the data lines
+func (c *assuanConn) response() (*memguard.LockedBuffer, error) {
+	var buffer *memguard.LockedBuffer
+	for {
+		word, endOfLine, err := c.readWord()
+		if err != nil {
+			destroyBuffer(buffer)
+			return nil, err
+		}
+
+		if word == "D" && !endOfLine {
+			line, err := memguard.NewBufferFromReaderUntil(c.r, '\n')
+			if err != nil {
+				destroyBuffer(line)
+				destroyBuffer(buffer)
+				return nil, err
+			}
+			buffer = appendBuffer(buffer, assuanUnescape(line))
+			continue
+		}
+
+		rest := ""
+		if !endOfLine {
+			if rest, err = c.readLine(); err != nil {
+				destroyBuffer(buffer)
+				return nil, err
+			}
+		}
+		switch word {
+		case "OK":
+			return buffer, nil
+		case "ERR":
+			destroyBuffer(buffer)
+			if strings.HasPrefix(rest, assuanCancelled) {
+				return nil, errs.With("Prompt cancelled")
+			}
+			return nil, errs.WithF(data.WithField("error", rest), "Pinentry returned an error")
+		case "INQUIRE":
+			if _, err := io.WriteString(c.w, "CAN\n"); err != nil {
+				destroyBuffer(buffer)
+				return nil, err
+			}
+		case "S", "#":
+		default:
+			destroyBuffer(buffer)
+			return nil, errs.WithF(data.WithField("line", word), "Unexpected pinentry response")
+		}
+	}
+}
+
+func (c *assuanConn) readWord() (string, bool, error) {
+	word := []byte{}
+	b := make([]byte, 1)
+	for len(word) < assuanMaxLine {
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return "", false, err
+		}
+		if b[0] == ' ' || b[0] == '\n' {
+			return string(word), b[0] == '\n', nil
+		}
+		word = append(word, b[0])
+	}
+	return "", false, errs.With("Pinentry response line is too long")
+}
+
+func (c *assuanConn) readLine() (string, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for len(line) < assuanMaxLine {
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errs.With("Pinentry response line is too long")
+}
+
+func assuanEscape(arg string) string {
+	return strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D").Replace(arg)
+}
+
+// assuanUnescape decodes the %XX escapes of buffer in place, returns nil when empty
+func assuanUnescape(buffer *memguard.LockedBuffer) *memguard.LockedBuffer {
+	if buffer.Size() == 0 {
+		buffer.Destroy()
+		return nil
+	}
+	buffer.Melt()
+	b := buffer.Bytes()
+	n := 0
+	for i := 0; i < len(b); i++ {
+		if b[i] == '%' && i+2 < len(b) && isHex(b[i+1]) && isHex(b[i+2]) {
+			b[n] = unhex(b[i+1])<<4 | unhex(b[i+2])
+			i += 2
+		} else {
+			b[n] = b[i]
+		}
+		n++
+	}
+	decoded := memguard.NewBufferFromBytes(b[:n])
+	buffer.Destroy()
+	return decoded
+}
+
+func destroyBuffer(buffer *memguard.LockedBuffer) {
+	if buffer != nil {
+		buffer.Destroy()
+	}
+}
+
+// appendBuffer returns the concatenation of a and b, destroying them
+func appendBuffer(a, b *memguard.LockedBuffer) *memguard.LockedBuffer {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	joined := memguard.NewBuffer(a.Size() + b.Size())
+	joined.Copy(a.Bytes())
+	joined.CopyAt(a.Size(), b.Bytes())
+	a.Destroy()
+	b.Destroy()
+	return joined
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,125 @@
+package memguarded
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePinentry writes a pinentry script answering the GETPIN commands with pins in order across its runs,
+// an ERR line is sent as is. Received commands are logged in the returned file.
+func fakePinentry(t *testing.T, pins ...string) (string, string) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "commands.log")
+	answers := ""
+	for i, pin := range pins {
+		answer := `echo "D ` + pin + `"; echo OK`
+		if strings.HasPrefix(pin, "ERR ") {
+			answer = `echo "` + pin + `"`
+		}
+		answers += "      " + strconv.Itoa(i+1) + ") " + answer + " ;;\n"
+	}
+
+	counter := filepath.Join(dir, "count")
+	script := filepath.Join(dir, "pinentry")
+	require.NoError(t, os.WriteFile(script, []byte(`#!/bin/sh
+echo "OK Pleased to meet you"
+while read -r line; do
+  echo "$line" >> "`+log+`"
+  case "$line" in
+    GETPIN)
+      count=$(($(cat "`+counter+`" 2>/dev/null || echo 0) + 1))
+      echo $count > "`+counter+`"
+      case $count in
+`+answers+`      *) echo "ERR 1 no more pins" ;;
+      esac ;;
+    BYE) echo "OK closing connection"; exit 0 ;;
+    *) echo "# comment"; echo "S PROGRESS"; echo OK ;;
+  esac
+done
+`), 0700))
+	return script, log
+}
+
+type fakePrompter struct {
+	secret string
+}
+
+func (p fakePrompter) Prompt(request PromptRequest) (*memguard.LockedBuffer, error) {
+	return memguard.NewBufferFromBytes([]byte(p.secret)), nil
+}
+
+func TestService_AskSecretUsesPrompter(t *testing.T) {
+	service := NewService()
+	service.Prompter = fakePrompter{secret: "faked"}
+	require.NoError(t, service.AskSecret(true, "Secret"))
+	assert.Equal(t, "faked", secretOf(t, service))
+}
+
+func TestPinentryPrompter(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh for the fake pinentry")
+	}
+	t.Setenv("GPG_TTY", "")
+
+	tests := []struct {
+		name         string
+		confirmation bool
+		description  string
+		pins         []string
+		expected     string
+		commands     []string
+	}{
+		{"simple", false, "Unlock it", []string{"s3cret"}, "s3cret",
+			[]string{"SETDESC Unlock it", "SETPROMPT Secret:", "SETTITLE test", "GETPIN", "BYE"}},
+		{"default description", false, "", []string{"s3cret"}, "s3cret",
+			[]string{"SETDESC Enter the secret", "SETPROMPT Secret:", "SETTITLE test", "GETPIN", "BYE"}},
+		{"escaped", false, "Unlock it", []string{"100%25%0Anew line"}, "100%\nnew line", nil},
+		{"confirmed", true, "Unlock it", []string{"s3cret", "s3cret"}, "s3cret",
+			[]string{"SETDESC Unlock it", "SETPROMPT Secret:", "SETTITLE test", "GETPIN", "SETPROMPT Confirm:", "GETPIN", "BYE"}},
+		{"mismatch then confirmed", true, "Unlock it", []string{"s3cret", "other", "s3cret", "s3cret"}, "s3cret",
+			[]string{"GETPIN", "SETPROMPT Confirm:", "GETPIN", "BYE",
+				"SETDESC Unlock it", "SETPROMPT Secret:", "SETTITLE test", "SETERROR Secrets do not match",
+				"GETPIN", "SETPROMPT Confirm:", "GETPIN", "BYE"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script, log := fakePinentry(t, test.pins...)
+			service := NewService()
+			service.Prompter = &PinentryPrompter{Path: script, Title: "test", Description: test.description}
+
+			require.NoError(t, service.AskSecret(test.confirmation, "Secret"))
+			assert.Equal(t, test.expected, secretOf(t, service))
+
+			content, err := os.ReadFile(log)
+			require.NoError(t, err)
+			if test.commands != nil {
+				assert.Contains(t, string(content), strings.Join(test.commands, "\n")+"\n")
+			}
+		})
+	}
+}
+
+func TestPinentryPrompter_Errors(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh for the fake pinentry")
+	}
+
+	script, _ := fakePinentry(t, "ERR 83886179 Operation cancelled")
+	_, err := (&PinentryPrompter{Path: script}).Prompt(PromptRequest{Prompt: "Secret"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Prompt cancelled")
+
+	script, _ = fakePinentry(t, "ERR 12 failure")
+	_, err = (&PinentryPrompter{Path: script}).Prompt(PromptRequest{Prompt: "Secret"})
+	assert.Error(t, err)
+
+	_, err = (&PinentryPrompter{Path: filepath.Join(t.TempDir(), "missing")}).Prompt(PromptRequest{Prompt: "Secret"})
+	assert.Error(t, err)
+}
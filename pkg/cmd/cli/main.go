@@ -29,7 +29,11 @@ func main() {
 
 func execute() error {
 	if len(os.Args) < 2 {
-		return errs.WithF(data.WithField("commands", "get|set|server|version"), "command required")
+		return errs.WithF(data.WithField("commands", "get|set|rotate|versions|list|clear|delete|unseal|split|submit-share|status|server|audit-verify|pki|version"), "command required")
+	}
+
+	if os.Args[1] == "pki" {
+		return executePki()
 	}
 
 	flags := flag.NewFlagSet("command", flag.ExitOnError)
@@ -39,7 +43,39 @@ func execute() error {
 	serverKey := flags.String("server-key", "certs/server.key", "server key")
 	serverPem := flags.String("server-pem", "certs/server.pem", "server pem")
 	caPem := flags.String("ca-pem", "certs/ca.pem", "ca pem")
+	serverCa := flags.String("server-ca", "certs/ca.pem", "CA bundle verifying the server certificate, empty to only check --server-pin")
+	serverPin := flags.String("server-pin", "", "Hex sha256 of the server certificate public key")
+	insecureSkipVerify := flags.Bool("insecure-skip-verify", false, "Connect without verifying the server certificate when --server-ca and --server-pin are empty")
+	certPassphraseSource := sourceFlags(flags, "cert-passphrase", "cert passphrase")
+	secretSource := sourceFlags(flags, "secret", "secret to set")
+	snapshotPassphraseSource := sourceFlags(flags, "snapshot-passphrase", "snapshot passphrase to unseal")
+	shareSource := sourceFlags(flags, "share", "hex share to submit")
+	pinentry := flags.String("pinentry", "", "Ask secrets with this pinentry program instead of the terminal")
+	name := flags.String("name", memguarded.DefaultSecretName, "secret name")
 	debug := flags.Bool("debug", false, "debug")
+	ttl := flags.Duration("ttl", 0, "Destroy the secret after this duration on the server")
+	idleTTL := flags.Duration("idle-ttl", 0, "Destroy the secret on the server when not read for this duration")
+	wait := flags.Duration("wait", 0, "Wait up to this duration for the secret to be set")
+	version := flags.Uint64("version", 0, "get this version of the secret instead of the current one")
+	grace := flags.Duration("grace", 0, "rotate keeps the previous version readable for this duration, server default if 0")
+	rotationGrace := flags.Duration("rotation-grace", time.Hour, "Server keeps the previous version readable for this duration on rotate without grace")
+	defaultTTL := flags.Duration("default-ttl", 0, "Server ttl of secrets set without one")
+	maxTTL := flags.Duration("max-ttl", 0, "Server maximum ttl of secrets")
+	policyFile := flags.String("policy", "", "Server json policy file restricting commands per peer process")
+	maxConnections := flags.Int("max-connections", 16, "Maximum number of client connections handled at the same time")
+	maxWaiters := flags.Int("max-waiters", 256, "Maximum number of clients waiting for a secret, not counted in max-connections")
+	reloadInterval := flags.Duration("reload-interval", time.Minute, "Server checks its certificate files for changes at this interval, 0 to only reload on SIGHUP")
+	revocationFile := flags.String("revocation-list", "", "Server CRL or denylist file of revoked client certificates")
+	snapshotFile := flags.String("snapshot", "", "Server keeps its secrets in this encrypted file, restored by unseal")
+	snapshotKeyFile := flags.String("snapshot-key-file", "", "Server unseals the snapshot at start with this 32 bytes key file instead of a passphrase")
+	snapshotCreate := flags.Bool("create", false, "unseal creates the snapshot when the server has none")
+	shamirThreshold := flags.Int("shamir-threshold", 0, "Server rebuilds the snapshot key, or the secret, from this number of shares submitted by different clients")
+	shareCount := flags.Int("shares", 5, "split creates this number of shares")
+	shareOut := flags.String("share-out", "", "split writes the shares as <share-out>.<n>.share")
+	generateKey := flags.Bool("generate-key", false, "split a new snapshot key instead of a secret")
+	auditFile := flags.String("audit-file", "", "Server appends a hash chained record of each connection and command to this file, read by audit-verify")
+	auditSyslog := flags.Bool("audit-syslog", false, "Server sends the audit records to syslog")
+	jsonOutput := flags.Bool("json", false, "status prints the json report, for monitoring")
 	continueOnError := flags.Bool("continue-on-error", false, "Do not stop the server on any error")
 
 	if err := flags.Parse(os.Args[2:]); err != nil {
@@ -65,13 +101,51 @@ func execute() error {
 	config := memguarded.CliConfig{
 		CertPassphrase:       &memguarded.Service{},
 		Secret:               &memguarded.Service{},
+		SecretName:           *name,
+		TTL:                  *ttl,
+		IdleTTL:              *idleTTL,
+		Wait:                 *wait,
+		Version:              *version,
+		Grace:                *grace,
+		JSON:                 *jsonOutput,
+		AppVersion:           Version,
+		RotationGrace:        *rotationGrace,
 		StopOnAnyClientError: *continueOnError,
+		MaxConnections:       *maxConnections,
+		MaxWaiters:           *maxWaiters,
+		PolicyFile:           *policyFile,
+		DefaultTTL:           *defaultTTL,
+		MaxTTL:               *maxTTL,
+		ReloadInterval:       *reloadInterval,
+		RevocationFile:       *revocationFile,
+		SnapshotFile:         *snapshotFile,
+		SnapshotKeyFile:      *snapshotKeyFile,
+		SnapshotCreate:       *snapshotCreate,
+		ShamirThreshold:      *shamirThreshold,
+		AuditFile:            *auditFile,
+		AuditSyslog:          *auditSyslog,
+		ShareCount:           *shareCount,
+		ShareOut:             *shareOut,
+		ShareGenerateKey:     *generateKey,
 		SocketPath:           *socketPath,
 		ClientKey:            *clientKey,
 		ClientPem:            *clientPem,
 		ServerKey:            *serverKey,
 		ServerPem:            *serverPem,
 		CaPem:                *caPem,
+		ServerCaPem:          *serverCa,
+		ServerPin:            *serverPin,
+		InsecureSkipVerify:   *insecureSkipVerify,
+	}
+
+	config.CertPassphraseSource = certPassphraseSource()
+	config.SecretSource = secretSource()
+	config.SnapshotPassphraseSource = snapshotPassphraseSource()
+	config.ShareSource = shareSource()
+	if *pinentry != "" {
+		config.Prompter = &memguarded.PinentryPrompter{Path: *pinentry, Title: app}
+		config.CertPassphrase.Prompter = config.Prompter
+		config.Secret.Prompter = config.Prompter
 	}
 
 	switch os.Args[1] {
@@ -79,11 +153,97 @@ func execute() error {
 		return memguarded.GetSecret(config)
 	case "set":
 		return memguarded.SetSecret(config)
+	case "rotate":
+		return memguarded.RotateSecret(config)
+	case "versions":
+		return memguarded.SecretVersions(config)
+	case "list":
+		return memguarded.ListSecrets(config)
+	case "clear":
+		return memguarded.ClearSecret(config)
+	case "delete":
+		return memguarded.DeleteSecret(config)
+	case "unseal":
+		return memguarded.Unseal(config)
+	case "split":
+		return memguarded.SplitShares(config)
+	case "submit-share":
+		return memguarded.SubmitShare(config)
+	case "status":
+		return memguarded.ServerStatus(config)
 	case "server":
 		return memguarded.StartServer(config)
+	case "audit-verify":
+		return memguarded.VerifyAudit(config)
 	default:
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 	return nil
 }
+
+func executePki() error {
+	if len(os.Args) < 3 {
+		return errs.WithF(data.WithField("commands", "init|issue-client|issue-server|revoke"), "pki command required")
+	}
+
+	flags := flag.NewFlagSet("pki", flag.ExitOnError)
+	dir := flags.String("pki-dir", "certs", "directory of the ca, certificates and keys")
+	commonName := flags.String("cn", "", "common name of the certificate")
+	out := flags.String("out", "", "name of the issued certificate, written as <out>.pem and <out>.key")
+	validFor := flags.Duration("valid-for", 365*24*time.Hour, "validity of the certificate")
+	pinentry := flags.String("pinentry", "", "Ask passphrases with this pinentry program instead of the terminal")
+	keyType := flags.String("key-type", memguarded.KeyTypeRSA, "key type, rsa, ecdsa or ed25519")
+	debug := flags.Bool("debug", false, "debug")
+
+	if err := flags.Parse(os.Args[3:]); err != nil {
+		return err
+	}
+
+	if *debug {
+		logs.SetLevel(logs.TRACE)
+	}
+
+	config := memguarded.CliConfig{
+		PkiDir:     *dir,
+		CommonName: *commonName,
+		CertName:   *out,
+		ValidFor:   *validFor,
+		KeyType:    *keyType,
+	}
+	if *pinentry != "" {
+		config.Prompter = &memguarded.PinentryPrompter{Path: *pinentry, Title: app}
+	}
+
+	switch os.Args[2] {
+	case "init":
+		return memguarded.PkiInit(config)
+	case "issue-client":
+		return memguarded.PkiIssueClient(config)
+	case "issue-server":
+		return memguarded.PkiIssueServer(config)
+	case "revoke":
+		return memguarded.PkiRevoke(config)
+	default:
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+	return nil
+}
+
+// sourceFlags registers the flags selecting where to read a secret instead of asking it
+func sourceFlags(flags *flag.FlagSet, prefix string, description string) func() memguarded.SecretSource {
+	fd := flags.Int(prefix+"-fd", -1, "Read the "+description+" from this file descriptor")
+	file := flags.String(prefix+"-file", "", "Read the "+description+" from this file")
+	shred := flags.Bool(prefix+"-file-shred", false, "Overwrite and remove the "+description+" file once read")
+	env := flags.String(prefix+"-env", "", "Read the "+description+" from this env variable, then unset it")
+	stdin := flags.Bool(prefix+"-stdin", false, "Read the "+description+" from stdin when it is a pipe")
+
+	return func() memguarded.SecretSource {
+		source := memguarded.SecretSource{File: *file, Shred: *shred, Env: *env, Stdin: *stdin}
+		if *fd >= 0 {
+			source.Reader = os.NewFile(uintptr(*fd), prefix)
+		}
+		return source
+	}
+}
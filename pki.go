@@ -0,0 +1,226 @@
+package memguarded
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"github.com/youmark/pkcs8"
+)
+
+const (
+	pkiCA         = "ca"
+	pkiRevoked    = "revoked"
+	pkiRSAKeySize = 3072
+
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// pkcs8Opts encrypts private keys with PBES2, PBKDF2-SHA256 and AES-256-CBC
+var pkcs8Opts = &pkcs8.Opts{
+	Cipher: pkcs8.AES256CBC,
+	KDFOpts: pkcs8.PBKDF2Opts{
+		SaltSize:       16,
+		IterationCount: 100000,
+		HMACHash:       crypto.SHA256,
+	},
+}
+
+// PKI creates the certificate authority, server and client certificates in Dir.
+// Each certificate is written as <name>.pem with its key in <name>.key.
+type PKI struct {
+	Dir      string
+	ValidFor time.Duration
+	KeyType  string // rsa if empty, ecdsa (P-256) or ed25519
+}
+
+// Init creates the certificate authority, its key encrypted with caPassphrase
+func (p *PKI) Init(caPassphrase *Service, commonName string) error {
+	if err := os.MkdirAll(p.Dir, 0700); err != nil {
+		return errs.WithEF(err, data.WithField("dir", p.Dir), "Failed to create pki directory")
+	}
+
+	key, err := p.generateKey()
+	if err != nil {
+		return errs.WithE(err, "Failed to generate CA key")
+	}
+	defer wipePrivateKey(key)
+	template, err := p.template(commonName)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return errs.WithE(err, "Failed to create CA certificate")
+	}
+	return p.write(pkiCA, der, key, caPassphrase)
+}
+
+// IssueServer creates a server certificate signed by the CA, its key is encrypted with keyPassphrase if set
+func (p *PKI) IssueServer(caPassphrase *Service, keyPassphrase *Service, name string, commonName string) error {
+	return p.issue(caPassphrase, keyPassphrase, name, commonName, x509.ExtKeyUsageServerAuth)
+}
+
+// IssueClient creates a client certificate signed by the CA, its key is encrypted with keyPassphrase if set
+func (p *PKI) IssueClient(caPassphrase *Service, keyPassphrase *Service, name string, commonName string) error {
+	return p.issue(caPassphrase, keyPassphrase, name, commonName, x509.ExtKeyUsageClientAuth)
+}
+
+// Revoke adds the certificate name to the revocation list of the pki dir, to give to the server
+func (p *PKI) Revoke(name string) error {
+	content, err := os.ReadFile(p.Path(name, ".pem"))
+	if err != nil {
+		return errs.WithEF(err, data.WithField("name", name), "Failed to read certificate")
+	}
+	certs, err := parseCertificates(content)
+	if err != nil || len(certs) == 0 {
+		return errs.WithEF(err, data.WithField("name", name), "Failed to parse certificate")
+	}
+	return AppendRevocation(p.RevocationFile(), certs[0])
+}
+
+// RevocationFile is the denylist maintained by Revoke
+func (p *PKI) RevocationFile() string {
+	return p.Path(pkiRevoked, ".list")
+}
+
+// Path returns the file of name with ext, .pem for the certificate or .key for its key
+func (p *PKI) Path(name string, ext string) string {
+	return filepath.Join(p.Dir, name+ext)
+}
+
+/////////////////////
+
+func (p *PKI) issue(caPassphrase *Service, keyPassphrase *Service, name string, commonName string, usage x509.ExtKeyUsage) error {
+	ca, err := loadX509KeyPair(p.Path(pkiCA, ".pem"), p.Path(pkiCA, ".key"), caPassphrase)
+	if err != nil {
+		return errs.WithE(err, "Failed to load CA")
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return errs.WithE(err, "Failed to parse CA certificate")
+	}
+
+	key, err := p.generateKey()
+	if err != nil {
+		return errs.WithE(err, "Failed to generate key")
+	}
+	defer wipePrivateKey(key)
+	template, err := p.template(commonName)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), ca.PrivateKey)
+	if err != nil {
+		return errs.WithE(err, "Failed to create certificate")
+	}
+	return p.write(name, der, key, keyPassphrase)
+}
+
+func (p *PKI) generateKey() (crypto.Signer, error) {
+	switch p.KeyType {
+	case "", KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, pkiRSAKeySize)
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, errs.WithF(data.WithField("type", p.KeyType), "Unknown key type")
+	}
+}
+
+func (p *PKI) template(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to generate serial number")
+	}
+	validFor := p.ValidFor
+	if validFor <= 0 {
+		validFor = 365 * 24 * time.Hour
+	}
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"memguarded"}},
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(validFor),
+	}, nil
+}
+
+// write refuses to overwrite an existing certificate or key, the encoded key is wiped once written
+func (p *PKI) write(name string, der []byte, key crypto.PrivateKey, passphrase *Service) error {
+	keyBlock := &pem.Block{Type: "PRIVATE KEY"}
+	defer func() { memguard.WipeBytes(keyBlock.Bytes) }()
+	if passphrase != nil && passphrase.IsSet() {
+		buffer, err := passphrase.Get()
+		if err != nil {
+			return errs.WithE(err, "Failed to open passphrase")
+		}
+		keyBlock.Type = "ENCRYPTED PRIVATE KEY"
+		keyBlock.Bytes, err = pkcs8.MarshalPrivateKey(key, buffer.Bytes(), pkcs8Opts)
+		buffer.Destroy()
+		if err != nil {
+			return errs.WithE(err, "Failed to encrypt private key")
+		}
+	} else {
+		var err error
+		if keyBlock.Bytes, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+			return errs.WithE(err, "Failed to marshal private key")
+		}
+		logs.WithF(data.WithField("name", name)).Warn("Private key is written unencrypted")
+	}
+
+	keyPem := pem.EncodeToMemory(keyBlock)
+	err := writeNewFile(p.Path(name, ".key"), keyPem, 0600)
+	memguard.WipeBytes(keyPem)
+	if err != nil {
+		return err
+	}
+	return writeNewFile(p.Path(name, ".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func writeNewFile(path string, content []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", path), "Failed to create file")
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return errs.WithEF(err, data.WithField("file", path), "Failed to write file")
+	}
+	if err := file.Close(); err != nil {
+		return errs.WithEF(err, data.WithField("file", path), "Failed to close file")
+	}
+	return nil
+}
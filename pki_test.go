@@ -0,0 +1,132 @@
+package memguarded
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPassphrase(value string) *Service {
+	passphrase := NewService()
+	secret := []byte(value)
+	passphrase.FromBytes(&secret)
+	return passphrase
+}
+
+func readTestCertificate(t *testing.T, path string) *x509.Certificate {
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	block, _ := pem.Decode(content)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestPKI_IssuedCertificatesConnect(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		t.Run(keyType, func(t *testing.T) {
+			testPKIConnect(t, &PKI{Dir: filepath.Join(t.TempDir(), "certs"), KeyType: keyType})
+		})
+	}
+}
+
+func testPKIConnect(t *testing.T, pki *PKI) {
+	caPassphrase := testPassphrase("ca passphrase")
+	require.NoError(t, pki.Init(caPassphrase, "test ca"))
+	require.NoError(t, pki.IssueServer(caPassphrase, testPassphrase("server passphrase"), "server", "test server"))
+	require.NoError(t, pki.IssueClient(caPassphrase, testPassphrase("client passphrase"), "client", "test client"))
+
+	ca := readTestCertificate(t, pki.Path("ca", ".pem"))
+	assert.True(t, ca.IsCA)
+	server := readTestCertificate(t, pki.Path("server", ".pem"))
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, server.ExtKeyUsage)
+	assert.NoError(t, server.CheckSignatureFrom(ca))
+	client := readTestCertificate(t, pki.Path("client", ".pem"))
+	assert.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, client.ExtKeyUsage)
+	assert.Equal(t, "test client", client.Subject.CommonName)
+
+	for _, name := range []string{"ca", "server", "client"} {
+		content, err := os.ReadFile(pki.Path(name, ".key"))
+		require.NoError(t, err)
+		block, _ := pem.Decode(content)
+		assert.Equal(t, "ENCRYPTED PRIVATE KEY", block.Type)
+		stat, err := os.Stat(pki.Path(name, ".key"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+	}
+
+	_, err := loadX509KeyPair(pki.Path("client", ".pem"), pki.Path("client", ".key"), testPassphrase("wrong"))
+	assert.Error(t, err)
+
+	socketServer := runTestServer(t, &Server{
+		SocketPath:     filepath.Join(pki.Dir, "test.sock"),
+		CertPem:        pki.Path("server", ".pem"),
+		CertKey:        pki.Path("server", ".key"),
+		CAPem:          pki.Path("ca", ".pem"),
+		CertPassphrase: testPassphrase("server passphrase"),
+	}, NewStore())
+
+	c := &Client{
+		SocketPath:     socketServer.SocketPath,
+		CertPem:        pki.Path("client", ".pem"),
+		CertKey:        pki.Path("client", ".key"),
+		CAPem:          pki.Path("ca", ".pem"),
+		CertPassphrase: testPassphrase("client passphrase"),
+	}
+	require.NoError(t, c.Connect())
+	defer c.Close()
+	names, err := c.ListSecrets()
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestPKI_DoesNotOverwrite(t *testing.T) {
+	pki := &PKI{Dir: t.TempDir()}
+	caPassphrase := testPassphrase("ca passphrase")
+	require.NoError(t, pki.Init(caPassphrase, "test ca"))
+	before, err := os.ReadFile(pki.Path("ca", ".key"))
+	require.NoError(t, err)
+
+	assert.Error(t, pki.Init(caPassphrase, "test ca"))
+	after, err := os.ReadFile(pki.Path("ca", ".key"))
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	assert.Error(t, pki.IssueClient(testPassphrase("wrong"), nil, "client", "test client"))
+	_, err = os.Stat(pki.Path("client", ".key"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPKI_EncryptedServerKeyNeedsPassphrase(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := &PKI{Dir: t.TempDir(), KeyType: KeyTypeECDSA}
+	caPassphrase := testPassphrase("ca passphrase")
+	require.NoError(t, pki.Init(caPassphrase, "test ca"))
+	require.NoError(t, pki.IssueServer(caPassphrase, testPassphrase("server passphrase"), "server", "test server"))
+
+	encrypted, err := isEncryptedKeyFile(pki.Path("server", ".key"))
+	require.NoError(t, err)
+	assert.True(t, encrypted)
+
+	for _, passphrase := range []*Service{nil, testPassphrase("wrong")} {
+		server := &Server{
+			SocketPath:     filepath.Join(pki.Dir, "test.sock"),
+			CertPem:        pki.Path("server", ".pem"),
+			CertKey:        pki.Path("server", ".key"),
+			CAPem:          pki.Path("ca", ".pem"),
+			CertPassphrase: passphrase,
+		}
+		require.NoError(t, server.InitStore(NewStore()))
+		assert.Error(t, server.Start())
+	}
+}
@@ -0,0 +1,239 @@
+package memguarded
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// Policy restricts who can run which command, on top of the same user check.
+// It is loaded from a json file like:
+//
+//	{
+//	  "peers": [
+//	    {"commands": ["get_secret"], "exes": ["/usr/bin/deploy-agent"]},
+//	    {"commands": ["set_secret"]}
+//	  ],
+//	  "certificates": [
+//	    {"common_names": ["reader"], "commands": ["get_secret", "wait_secret"], "secrets": ["db"]},
+//	    {"organizational_units": ["ops"], "commands": ["set_secret", "clear_secret"]}
+//	  ]
+//	}
+type Policy struct {
+	Peers        []PeerRule        `json:"peers"`
+	Certificates []CertificateRule `json:"certificates"`
+}
+
+// PeerRule matches a peer process when all its non empty criteria match.
+// Rules are evaluated in order, the first one matching the command and the peer allows it, or denies it with Deny.
+// A command covered by some rules but matched by none is denied, a command covered by no rule is allowed.
+type PeerRule struct {
+	Commands  []string `json:"commands,omitempty"` // empty covers all commands
+	Deny      bool     `json:"deny,omitempty"`
+	Uids      []uint32 `json:"uids,omitempty"`
+	Gids      []uint32 `json:"gids,omitempty"`
+	Groups    []uint32 `json:"groups,omitempty"`     // any supplementary group
+	Exes      []string `json:"exes,omitempty"`       // path.Match patterns on /proc/<pid>/exe
+	ExeSha256 []string `json:"exe_sha256,omitempty"` // hex encoded
+	Cgroups   []string `json:"cgroups,omitempty"`    // path.Match patterns on any cgroup path
+}
+
+// CertificateRule grants commands on secrets to the client certificates matching all its non empty identity criteria.
+// When certificate rules are configured, a command is allowed only if a rule grants it.
+type CertificateRule struct {
+	CommonNames         []string `json:"common_names,omitempty"`         // path.Match patterns
+	OrganizationalUnits []string `json:"organizational_units,omitempty"` // path.Match patterns
+	URIs                []string `json:"uris,omitempty"`                 // path.Match patterns on SAN URIs
+	SPKISha256          []string `json:"spki_sha256,omitempty"`          // hex encoded
+	Commands            []string `json:"commands,omitempty"`             // empty grants all commands
+	Secrets             []string `json:"secrets,omitempty"`              // path.Match patterns, empty grants all secrets
+}
+
+func LoadPolicy(file string) (*Policy, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("file", file), "Failed to read policy file")
+	}
+
+	policy := &Policy{}
+	if err := json.Unmarshal(content, policy); err != nil {
+		return nil, errs.WithEF(err, data.WithField("file", file), "Failed to parse policy file")
+	}
+	return policy, nil
+}
+
+// authorizePeer returns an UNAUTHORIZED status error when the peer cannot run command
+func (p *Policy) authorizePeer(command string, peer *PeerInfo) error {
+	if p == nil {
+		return nil
+	}
+
+	covered := false
+	for i, rule := range p.Peers {
+		if !rule.coversCommand(command) {
+			continue
+		}
+		covered = true
+
+		if peer == nil {
+			return newStatusError(StatusUnauthorized, "Peer process is unknown")
+		}
+		if !rule.matches(peer) {
+			continue
+		}
+		if rule.Deny {
+			return errs.WithEF(newStatusError(StatusUnauthorized, "Peer process is denied"), data.WithField("rule", i), "Peer denied by policy")
+		}
+		return nil
+	}
+
+	if covered {
+		return newStatusError(StatusUnauthorized, "Peer process is not allowed")
+	}
+	return nil
+}
+
+// authorizeCertificate returns an UNAUTHORIZED status error when no rule grants command on secret to cert.
+// secret is empty for commands not targeting a secret.
+func (p *Policy) authorizeCertificate(command string, secret string, cert *x509.Certificate) error {
+	if p == nil || len(p.Certificates) == 0 {
+		return nil
+	}
+	if cert == nil {
+		return newStatusError(StatusUnauthorized, "Client certificate is unknown")
+	}
+
+	for _, rule := range p.Certificates {
+		if rule.matches(cert) && coversCommand(rule.Commands, command) && rule.coversSecret(secret) {
+			return nil
+		}
+	}
+	return newStatusError(StatusUnauthorized, "Client certificate is not allowed")
+}
+
+func (r CertificateRule) matches(cert *x509.Certificate) bool {
+	if len(r.CommonNames) > 0 && !matchAny(r.CommonNames, []string{cert.Subject.CommonName}) {
+		return false
+	}
+	if len(r.OrganizationalUnits) > 0 && !matchAny(r.OrganizationalUnits, cert.Subject.OrganizationalUnit) {
+		return false
+	}
+	if len(r.URIs) > 0 {
+		uris := []string{}
+		for _, uri := range cert.URIs {
+			uris = append(uris, uri.String())
+		}
+		if !matchAny(r.URIs, uris) {
+			return false
+		}
+	}
+	if len(r.SPKISha256) > 0 {
+		fingerprint := spkiSha256(cert)
+		found := false
+		for _, expected := range r.SPKISha256 {
+			if strings.EqualFold(expected, fingerprint) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (r CertificateRule) coversSecret(secret string) bool {
+	if len(r.Secrets) == 0 || secret == "" {
+		return true
+	}
+	return matchAny(r.Secrets, []string{secret})
+}
+
+func (r PeerRule) coversCommand(command string) bool {
+	return coversCommand(r.Commands, command)
+}
+
+// coversCommand returns true if command is in commands, or commands is empty
+func coversCommand(commands []string, command string) bool {
+	if len(commands) == 0 {
+		return true
+	}
+	for _, c := range commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PeerRule) matches(peer *PeerInfo) bool {
+	if len(r.Uids) > 0 && !containsUint32(r.Uids, peer.Uid) {
+		return false
+	}
+	if len(r.Gids) > 0 && !containsUint32(r.Gids, peer.Gid) {
+		return false
+	}
+	if len(r.Groups) > 0 && !anyUint32(r.Groups, peer.Groups) {
+		return false
+	}
+	if len(r.Exes) > 0 && !matchAny(r.Exes, []string{peer.Exe}) {
+		return false
+	}
+	if len(r.Cgroups) > 0 && !matchAny(r.Cgroups, peer.Cgroups) {
+		return false
+	}
+	if len(r.ExeSha256) > 0 {
+		hash, err := peer.ExeSha256()
+		if err != nil {
+			return false
+		}
+		found := false
+		for _, expected := range r.ExeSha256 {
+			if expected == hash {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsUint32(values []uint32, value uint32) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func anyUint32(values []uint32, candidates []uint32) bool {
+	for _, candidate := range candidates {
+		if containsUint32(values, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny returns true if a candidate matches one of the path.Match patterns
+func matchAny(patterns []string, candidates []string) bool {
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if candidate == "" {
+				continue
+			}
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
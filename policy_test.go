@@ -0,0 +1,127 @@
+package memguarded
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_AuthorizePeer(t *testing.T) {
+	policy := &Policy{Peers: []PeerRule{
+		{Commands: []string{"get_secret"}, Exes: []string{"/usr/bin/deploy-agent"}},
+		{Commands: []string{"get_secret"}, Groups: []uint32{42}, Cgroups: []string{"/system.slice/*.service"}},
+		{Commands: []string{"set_secret"}, Deny: true, Gids: []uint32{666}},
+		{Commands: []string{"set_secret"}},
+	}}
+
+	agent := &PeerInfo{Uid: 1000, Gid: 1000, Exe: "/usr/bin/deploy-agent"}
+	shell := &PeerInfo{Uid: 1000, Gid: 1000, Exe: "/bin/bash"}
+	service := &PeerInfo{Uid: 1000, Gid: 1000, Groups: []uint32{10, 42}, Exe: "/usr/bin/app", Cgroups: []string{"/system.slice/app.service"}}
+	evil := &PeerInfo{Uid: 1000, Gid: 666, Exe: "/bin/bash"}
+
+	tests := []struct {
+		command string
+		peer    *PeerInfo
+		allowed bool
+	}{
+		{"get_secret", agent, true},
+		{"get_secret", shell, false},
+		{"get_secret", service, true},
+		{"get_secret", nil, false},
+		{"set_secret", shell, true},
+		{"set_secret", evil, false},
+		{"list_secrets", shell, true},
+		{"list_secrets", nil, true},
+	}
+	for _, test := range tests {
+		err := policy.authorizePeer(test.command, test.peer)
+		if test.allowed {
+			assert.NoError(t, err, "%s %+v", test.command, test.peer)
+		} else {
+			assert.True(t, errors.Is(statusOf(err), ErrUnauthorized), "%s %+v", test.command, test.peer)
+		}
+	}
+}
+
+func TestPolicy_NilAllowsAll(t *testing.T) {
+	var policy *Policy
+	assert.NoError(t, policy.authorizePeer("get_secret", nil))
+}
+
+func TestPolicy_ExeSha256(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc")
+	}
+
+	exe, err := os.ReadFile("/proc/self/exe")
+	require.NoError(t, err)
+	sum := sha256.Sum256(exe)
+
+	self := &PeerInfo{Pid: int32(os.Getpid())}
+	allowed := &Policy{Peers: []PeerRule{{ExeSha256: []string{hex.EncodeToString(sum[:])}}}}
+	denied := &Policy{Peers: []PeerRule{{ExeSha256: []string{"00"}}}}
+
+	assert.NoError(t, allowed.authorizePeer("get_secret", self))
+	assert.Error(t, denied.authorizePeer("get_secret", self))
+}
+
+func TestLoadPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{"peers": [{"commands": ["get_secret"], "exes": ["/usr/bin/*"], "deny": true}]}`), 0600))
+
+	policy, err := LoadPolicy(file)
+	assert.NoError(t, err)
+	assert.Equal(t, []PeerRule{{Commands: []string{"get_secret"}, Exes: []string{"/usr/bin/*"}, Deny: true}}, policy.Peers)
+
+	require.NoError(t, os.WriteFile(file, []byte(`{`), 0600))
+	_, err = LoadPolicy(file)
+	assert.Error(t, err)
+}
+
+func TestPolicy_AuthorizeCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	reader := pki.issue(t, filepath.Join(pki.Dir, "reader.pem"), filepath.Join(pki.Dir, "reader.key"), "reader", x509.ExtKeyUsageClientAuth)
+	admin := pki.issue(t, filepath.Join(pki.Dir, "admin.pem"), filepath.Join(pki.Dir, "admin.key"), "admin", x509.ExtKeyUsageClientAuth)
+	other := pki.issue(t, filepath.Join(pki.Dir, "other.pem"), filepath.Join(pki.Dir, "other.key"), "other", x509.ExtKeyUsageClientAuth)
+
+	policy := &Policy{Certificates: []CertificateRule{
+		{CommonNames: []string{"reader"}, Commands: []string{"get_secret"}, Secrets: []string{"db*"}},
+		{SPKISha256: []string{spkiSha256(admin)}, Commands: []string{"set_secret", "clear_secret", "list_secrets"}},
+	}}
+
+	tests := []struct {
+		command string
+		secret  string
+		cert    *x509.Certificate
+		allowed bool
+	}{
+		{"get_secret", "db", reader, true},
+		{"get_secret", "db-replica", reader, true},
+		{"get_secret", "signing", reader, false},
+		{"set_secret", "db", reader, false},
+		{"set_secret", "db", admin, true},
+		{"clear_secret", "signing", admin, true},
+		{"get_secret", "db", admin, false},
+		{"list_secrets", "", admin, true},
+		{"list_secrets", "", other, false},
+		{"get_secret", "db", nil, false},
+	}
+	for _, test := range tests {
+		err := policy.authorizeCertificate(test.command, test.secret, test.cert)
+		if test.allowed {
+			assert.NoError(t, err, "%s %s", test.command, test.secret)
+		} else {
+			assert.True(t, errors.Is(statusOf(err), ErrUnauthorized), "%s %s", test.command, test.secret)
+		}
+	}
+
+	assert.NoError(t, (&Policy{}).authorizeCertificate("get_secret", "db", nil))
+}
@@ -0,0 +1,227 @@
+package memguarded
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"syscall"
+	"unicode"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// DefaultMaxAttempts is the number of entries asked when AskOptions.MaxAttempts is not set
+const DefaultMaxAttempts = 3
+
+// ErrSecretMismatch is returned by a Prompter when the confirmation entry differs from the secret
+var ErrSecretMismatch = errors.New("Secrets do not match")
+
+// Prompter asks a secret to a human, with a second entry in the same session to confirm it when request.Confirm is set
+type Prompter interface {
+	Prompt(request PromptRequest) (*memguard.LockedBuffer, error)
+}
+
+// PromptRequest is what a Prompter shows for one attempt
+type PromptRequest struct {
+	Prompt      string
+	Description string
+	Confirm     string // prompt of the confirmation entry, no confirmation if empty
+	Error       string // why the previous attempt was refused, empty on the first one
+}
+
+// AskOptions tunes how AskSecretWithOptions asks, checks and confirms a secret
+type AskOptions struct {
+	Confirmation bool
+	MaxAttempts  int     // DefaultMaxAttempts if not set, negative to ask until accepted
+	MinLength    int     // in bytes
+	MinEntropy   float64 // in bits, estimated from the length and the character classes used
+	// Validate is called before accepting the secret, like to decrypt a key, its error message is shown to retry
+	Validate func(secret *memguard.LockedBuffer) error
+	Texts    PromptTexts
+}
+
+// PromptTexts are the texts shown to the user, to translate them. Empty ones are the english default.
+type PromptTexts struct {
+	Prompt          string // name if empty
+	Description     string // "Enter the <name>" if empty
+	Confirm         string
+	Empty           string
+	Mismatch        string
+	TooShort        string // formatted with the minimum length
+	TooWeak         string
+	TooManyAttempts string
+}
+
+func (t PromptTexts) withDefaults(name string) PromptTexts {
+	return PromptTexts{
+		Prompt:          orDefault(t.Prompt, name),
+		Description:     orDefault(t.Description, "Enter the "+strings.ToLower(name)),
+		Confirm:         orDefault(t.Confirm, "Confirm"),
+		Empty:           orDefault(t.Empty, "Secret is empty"),
+		Mismatch:        orDefault(t.Mismatch, "Secrets do not match"),
+		TooShort:        orDefault(t.TooShort, "Secret must be at least %d characters"),
+		TooWeak:         orDefault(t.TooWeak, "Secret is too easy to guess"),
+		TooManyAttempts: orDefault(t.TooManyAttempts, "Too many attempts"),
+	}
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// ask prompts until a secret is accepted or the attempts are exhausted
+func (o AskOptions) ask(prompter Prompter, name string) (*memguard.LockedBuffer, error) {
+	texts := o.Texts.withDefaults(name)
+	maxAttempts := o.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	request := PromptRequest{Prompt: texts.Prompt, Description: texts.Description}
+	if o.Confirmation {
+		request.Confirm = texts.Confirm
+	}
+	for attempt := 1; maxAttempts < 0 || attempt <= maxAttempts; attempt++ {
+		secret, err := prompter.Prompt(request)
+		if errors.Is(err, ErrSecretMismatch) {
+			request.Error = texts.Mismatch
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if request.Error = o.check(secret, texts); request.Error != "" {
+			destroyBuffer(secret)
+			continue
+		}
+		return secret, nil
+	}
+	return nil, errs.WithF(data.WithField("reason", request.Error), texts.TooManyAttempts)
+}
+
+// confirmed returns secret when confirm is the same, destroying confirm, both can be nil when empty
+func confirmed(secret *memguard.LockedBuffer, confirm *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
+	match := secret == nil && confirm == nil ||
+		secret != nil && confirm != nil && secret.EqualTo(confirm.Bytes())
+	destroyBuffer(confirm)
+	if !match {
+		destroyBuffer(secret)
+		return nil, ErrSecretMismatch
+	}
+	return secret, nil
+}
+
+// check returns the message telling why secret is refused, empty when accepted
+func (o AskOptions) check(secret *memguard.LockedBuffer, texts PromptTexts) string {
+	size := 0
+	if secret != nil {
+		size = secret.Size()
+	}
+	if size == 0 {
+		if o.Confirmation || o.MinLength > 0 || o.MinEntropy > 0 || o.Validate != nil {
+			return texts.Empty
+		}
+		return ""
+	}
+	if size < o.MinLength {
+		return fmt.Sprintf(texts.TooShort, o.MinLength)
+	}
+	if o.MinEntropy > 0 && estimateEntropy(secret.Bytes()) < o.MinEntropy {
+		return texts.TooWeak
+	}
+	if o.Validate != nil {
+		if err := o.Validate(secret); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// estimateEntropy is the length times the bits of the pool of character classes used
+func estimateEntropy(secret []byte) float64 {
+	var lower, upper, digit, other bool
+	for _, c := range string(secret) {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return float64(len(secret)) * math.Log2(float64(pool))
+}
+
+// TerminalPrompter reads the secret on stdin without echo, stdout must be a terminal
+type TerminalPrompter struct{}
+
+func (p TerminalPrompter) Prompt(request PromptRequest) (*memguard.LockedBuffer, error) {
+	if !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		return nil, errs.With("Cannot ask secret, not in a terminal")
+	}
+	return readTerminal(request)
+}
+
+// stdinPrompter is the TerminalPrompter without the stdout check
+type stdinPrompter struct{}
+
+func (p stdinPrompter) Prompt(request PromptRequest) (*memguard.LockedBuffer, error) {
+	return readTerminal(request)
+}
+
+func readTerminal(request PromptRequest) (*memguard.LockedBuffer, error) {
+	if request.Error != "" {
+		fmt.Println()
+		fmt.Println(request.Error)
+		fmt.Println()
+	}
+	secret, err := readTerminalEntry(request.Prompt)
+	if err != nil || request.Confirm == "" {
+		return secret, err
+	}
+	confirm, err := readTerminalEntry(request.Confirm)
+	if err != nil {
+		destroyBuffer(secret)
+		return nil, err
+	}
+	return confirmed(secret, confirm)
+}
+
+// readTerminalEntry returns nil when the entry is empty
+func readTerminalEntry(prompt string) (*memguard.LockedBuffer, error) {
+	print(prompt + ": ")
+	secret, err := terminal.ReadPassword(syscall.Stdin)
+	print("\n")
+	if err != nil {
+		memguard.WipeBytes(secret)
+		return nil, errs.WithE(err, "Cannot read secret")
+	}
+	if len(secret) == 0 {
+		return nil, nil
+	}
+	return memguard.NewBufferFromBytes(secret), nil
+}
@@ -0,0 +1,114 @@
+package memguarded
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedPrompter answers the entries in order, two for a confirmed request, and records the requests it was given
+type scriptedPrompter struct {
+	entries  []string
+	prompts  []string
+	messages []string
+}
+
+func (p *scriptedPrompter) Prompt(request PromptRequest) (*memguard.LockedBuffer, error) {
+	p.prompts = append(p.prompts, request.Prompt)
+	p.messages = append(p.messages, request.Error)
+	secret, err := p.entry()
+	if err != nil || request.Confirm == "" {
+		return secret, err
+	}
+	confirm, err := p.entry()
+	if err != nil {
+		destroyBuffer(secret)
+		return nil, err
+	}
+	return confirmed(secret, confirm)
+}
+
+func (p *scriptedPrompter) entry() (*memguard.LockedBuffer, error) {
+	if len(p.entries) == 0 {
+		return nil, errors.New("no more entries")
+	}
+	entry := p.entries[0]
+	p.entries = p.entries[1:]
+	if entry == "" {
+		return nil, nil
+	}
+	return memguard.NewBufferFromBytes([]byte(entry)), nil
+}
+
+func TestAskOptions(t *testing.T) {
+	validate := func(secret *memguard.LockedBuffer) error {
+		if string(secret.Bytes()) != "right" {
+			return errors.New("Wrong key passphrase")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name     string
+		options  AskOptions
+		entries  []string
+		expected string
+		messages []string
+	}{
+		{"empty accepted", AskOptions{}, []string{""}, "", []string{""}},
+		{"confirmed", AskOptions{Confirmation: true}, []string{"s3cret", "s3cret"}, "s3cret", []string{""}},
+		{"mismatch", AskOptions{Confirmation: true}, []string{"s3cret", "other", "s3cret", "s3cret"}, "s3cret",
+			[]string{"", "Secrets do not match"}},
+		{"empty refused", AskOptions{Confirmation: true}, []string{"", "", "s3cret", "s3cret"}, "s3cret",
+			[]string{"", "Secret is empty"}},
+		{"too short", AskOptions{MinLength: 8}, []string{"short", "long enough"}, "long enough",
+			[]string{"", "Secret must be at least 8 characters"}},
+		{"too weak", AskOptions{MinEntropy: 60}, []string{"password", "c0rrect-H0rse-battery"}, "c0rrect-H0rse-battery",
+			[]string{"", "Secret is too easy to guess"}},
+		{"validate", AskOptions{Validate: validate}, []string{"wrong", "right"}, "right",
+			[]string{"", "Wrong key passphrase"}},
+		{"localized", AskOptions{MinLength: 8, Texts: PromptTexts{TooShort: "Au moins %d caractères"}}, []string{"court", "assez long"}, "assez long",
+			[]string{"", "Au moins 8 caractères"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prompter := &scriptedPrompter{entries: test.entries}
+			service := NewService()
+			service.Prompter = prompter
+
+			require.NoError(t, service.AskSecretWithOptions("Secret", test.options))
+			if test.expected == "" {
+				assert.False(t, service.IsSet())
+			} else {
+				assert.Equal(t, test.expected, secretOf(t, service))
+			}
+			assert.Equal(t, test.messages, prompter.messages)
+		})
+	}
+}
+
+func TestAskOptions_TooManyAttempts(t *testing.T) {
+	prompter := &scriptedPrompter{entries: []string{"a", "b", "c", "d"}}
+	service := NewService()
+	service.Prompter = prompter
+
+	err := service.AskSecretWithOptions("Secret", AskOptions{MinLength: 8, Texts: PromptTexts{Prompt: "Mot de passe", TooManyAttempts: "Trop d'essais"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Trop d'essais")
+	assert.Equal(t, []string{"Mot de passe", "Mot de passe", "Mot de passe"}, prompter.prompts)
+	assert.False(t, service.IsSet())
+
+	prompter = &scriptedPrompter{entries: []string{"a", "b", "c", "d", "long enough"}}
+	service.Prompter = prompter
+	require.NoError(t, service.AskSecretWithOptions("Secret", AskOptions{MinLength: 8, MaxAttempts: -1}))
+	assert.Len(t, prompter.prompts, 5)
+}
+
+func TestEstimateEntropy(t *testing.T) {
+	assert.Zero(t, estimateEntropy(nil))
+	assert.InDelta(t, 8*4.7, estimateEntropy([]byte("password")), 0.1)
+	assert.True(t, estimateEntropy([]byte("Password1!")) > estimateEntropy([]byte("password12")))
+}
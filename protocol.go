@@ -0,0 +1,443 @@
+package memguarded
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// Wire protocol versions.
+//
+// ProtocolText is the historical newline separated protocol, used when a client starts
+// talking without handshake. It cannot carry secrets containing a new line.
+//
+// ProtocolFramed starts with a handshake (magic + highest version supported by the client)
+// answered by the server with the version chosen and its capabilities, then uses length
+// prefixed frames:
+//
+//	request  = frame(command) uint8(argc) frame(arg)*argc frame(payload)
+//	response = uint8(status) frame(message) uint16(count) frame(value)*count frame(payload)
+//	frame    = uint32(big endian size) bytes
+//
+// Payloads are read directly into memguard buffers.
+const (
+	ProtocolText    = 1
+	ProtocolFramed  = 2
+	ProtocolVersion = ProtocolFramed
+)
+
+const (
+	maxFrameSize   = 4096
+	maxPayloadSize = 1 << 20
+	maxArguments   = 32
+)
+
+var protocolMagic = []byte{0, 'm', 'g', 'd'}
+
+type request struct {
+	Command string
+	Args    []string
+	Payload *memguard.LockedBuffer
+
+	// conn received the request, nil when not known
+	conn net.Conn
+	// slot of the connection in the worker pool, given back by commands blocking for long
+	slot *workerSlot
+	// client sent the request, nil when not known
+	client *clientInfo
+}
+
+// extendDeadline moves the connection deadline, for commands running longer than the server timeout
+func (r *request) extendDeadline(d time.Duration) error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.SetDeadline(time.Now().Add(d))
+}
+
+// watchPeer reads the connection while a command blocks, as the client must not send anything before the response.
+// gone is closed when the client goes away or sends anything, unwatch ends the watch and returns why it was.
+func (r *request) watchPeer() (gone <-chan struct{}, unwatch func() error) {
+	closed := make(chan struct{})
+	if r.conn == nil {
+		return closed, func() error { return nil }
+	}
+
+	var readErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if readErr = readPeer(r.conn); readErr != nil {
+			close(closed)
+		}
+	}()
+	return closed, func() error {
+		if err := r.conn.SetReadDeadline(time.Now()); err != nil {
+			return errs.WithE(err, "Failed to set deadline on socket connection")
+		}
+		<-done
+		return readErr
+	}
+}
+
+// readPeer blocks until the client sends anything or goes away, nil when the read deadline passes first
+func readPeer(conn net.Conn) error {
+	buffer := make([]byte, 1)
+	for {
+		n, err := conn.Read(buffer)
+		switch {
+		case n > 0:
+			return errs.With("Client sent data before the response")
+		case err == nil:
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return nil
+		default:
+			return errs.WithE(err, "Client went away")
+		}
+	}
+}
+
+// name returns the secret name targeted by the request
+func (r *request) name() string {
+	if len(r.Args) == 0 || r.Args[0] == "" {
+		return DefaultSecretName
+	}
+	return r.Args[0]
+}
+
+// hasPayload is false without payload or with an empty one, like an empty line of the text protocol
+func (r *request) hasPayload() bool {
+	return r.Payload != nil && r.Payload.Size() > 0
+}
+
+func (r *request) destroy() {
+	if r.Payload != nil {
+		r.Payload.Destroy()
+	}
+}
+
+type response struct {
+	Status  Status
+	Message string
+	Values  []string
+	// Payload is written directly from the locked buffer, then destroyed
+	Payload *memguard.LockedBuffer
+
+	// err is the server side cause of a non OK status
+	err error
+}
+
+func errorResponse(err error) *response {
+	status := statusOf(err)
+	return &response{Status: status.Status, Message: status.Message, err: err}
+}
+
+type serverCodec interface {
+	Version() int
+	ReadRequest() (*request, error)
+	WriteResponse(resp *response) error
+}
+
+// negotiate reads the client handshake, if any, and returns the codec to use on the connection
+func negotiate(conn io.ReadWriter, commands []string) (serverCodec, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return nil, err
+	}
+	if first[0] != protocolMagic[0] {
+		return &textCodec{reader: io.MultiReader(bytes.NewReader(first), conn), writer: conn}, nil
+	}
+
+	hello := make([]byte, len(protocolMagic))
+	if _, err := io.ReadFull(conn, hello[1:]); err != nil {
+		return nil, errs.WithE(err, "Failed to read handshake")
+	}
+	if !bytes.Equal(hello[1:], protocolMagic[1:]) {
+		return nil, errs.With("Invalid handshake magic")
+	}
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return nil, errs.WithE(err, "Failed to read handshake version")
+	}
+
+	version := int(first[0])
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < ProtocolFramed {
+		return nil, errs.WithF(data.WithField("version", first[0]), "Unsupported protocol version in handshake")
+	}
+
+	if err := WriteBytes(conn, append(append([]byte{}, protocolMagic...), byte(version))); err != nil {
+		return nil, errs.WithE(err, "Failed to write handshake")
+	}
+	if err := writeFrame(conn, []byte(strings.Join(commands, " "))); err != nil {
+		return nil, errs.WithE(err, "Failed to write capabilities")
+	}
+	return &framedCodec{conn: conn, version: version}, nil
+}
+
+// clientHandshake sends the highest version supported and returns the version and capabilities of the server
+func clientHandshake(conn io.ReadWriter) (int, []string, error) {
+	if err := WriteBytes(conn, append(append([]byte{}, protocolMagic...), ProtocolVersion)); err != nil {
+		return 0, nil, errs.WithE(err, "Failed to write handshake")
+	}
+
+	hello := make([]byte, len(protocolMagic)+1)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return 0, nil, errs.WithE(err, "Failed to read handshake")
+	}
+	if !bytes.Equal(hello[:len(protocolMagic)], protocolMagic) {
+		return 0, nil, errs.With("Invalid handshake magic from server")
+	}
+
+	capabilities, err := readFrame(conn, maxFrameSize)
+	if err != nil {
+		return 0, nil, errs.WithE(err, "Failed to read server capabilities")
+	}
+	return int(hello[len(protocolMagic)]), strings.Fields(string(capabilities)), nil
+}
+
+/////////////////////
+
+type framedCodec struct {
+	conn    io.ReadWriter
+	version int
+}
+
+func (c *framedCodec) Version() int {
+	return c.version
+}
+
+func (c *framedCodec) ReadRequest() (*request, error) {
+	command, err := readFrame(c.conn, maxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	req := &request{Command: string(command)}
+
+	argc := make([]byte, 1)
+	if _, err := io.ReadFull(c.conn, argc); err != nil {
+		return nil, errs.WithE(err, "Failed to read arguments count")
+	}
+	if argc[0] > maxArguments {
+		return nil, errs.WithF(data.WithField("count", argc[0]), "Too many arguments")
+	}
+	for i := 0; i < int(argc[0]); i++ {
+		arg, err := readFrame(c.conn, maxFrameSize)
+		if err != nil {
+			return nil, errs.WithE(err, "Failed to read argument")
+		}
+		req.Args = append(req.Args, string(arg))
+	}
+
+	req.Payload, err = readPayload(c.conn)
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to read payload")
+	}
+	return req, nil
+}
+
+func (c *framedCodec) WriteResponse(resp *response) error {
+	if resp.Payload != nil {
+		defer resp.Payload.Destroy()
+	}
+
+	if err := WriteBytes(c.conn, []byte{byte(resp.Status)}); err != nil {
+		return err
+	}
+	if err := writeFrame(c.conn, []byte(resp.Message)); err != nil {
+		return err
+	}
+
+	count := make([]byte, 2)
+	binary.BigEndian.PutUint16(count, uint16(len(resp.Values)))
+	if err := WriteBytes(c.conn, count); err != nil {
+		return err
+	}
+	for _, value := range resp.Values {
+		if err := writeFrame(c.conn, []byte(value)); err != nil {
+			return err
+		}
+	}
+	return writePayload(c.conn, resp.Payload)
+}
+
+// writeRequest is the client side of framedCodec.ReadRequest
+func writeRequest(w io.Writer, command string, args []string, payload *memguard.LockedBuffer) error {
+	if err := writeFrame(w, []byte(command)); err != nil {
+		return err
+	}
+	if err := WriteBytes(w, []byte{byte(len(args))}); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := writeFrame(w, []byte(arg)); err != nil {
+			return err
+		}
+	}
+	return writePayload(w, payload)
+}
+
+// readResponse is the client side of framedCodec.WriteResponse, a non OK status is returned as a *StatusError
+func readResponse(r io.Reader) ([]string, *memguard.LockedBuffer, error) {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return nil, nil, errs.WithE(err, "Failed to read response status")
+	}
+	message, err := readFrame(r, maxFrameSize)
+	if err != nil {
+		return nil, nil, errs.WithE(err, "Failed to read response message")
+	}
+
+	count := make([]byte, 2)
+	if _, err := io.ReadFull(r, count); err != nil {
+		return nil, nil, errs.WithE(err, "Failed to read response")
+	}
+
+	values := []string{}
+	for i := 0; i < int(binary.BigEndian.Uint16(count)); i++ {
+		value, err := readFrame(r, maxFrameSize)
+		if err != nil {
+			return nil, nil, errs.WithE(err, "Failed to read response value")
+		}
+		values = append(values, string(value))
+	}
+
+	payload, err := readPayload(r)
+	if err != nil {
+		return nil, nil, errs.WithE(err, "Failed to read response payload")
+	}
+
+	if Status(status[0]) != StatusOK {
+		if payload != nil {
+			payload.Destroy()
+		}
+		return nil, nil, newStatusError(Status(status[0]), string(message))
+	}
+	return values, payload, nil
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(frame)))
+	if err := WriteBytes(w, size); err != nil {
+		return err
+	}
+	return WriteBytes(w, frame)
+}
+
+func readFrameSize(r io.Reader, max uint32) (uint32, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return 0, err
+	}
+	frameSize := binary.BigEndian.Uint32(size)
+	if frameSize > max {
+		return 0, errs.WithF(data.WithField("size", frameSize).WithField("max", max), "Frame too large")
+	}
+	return frameSize, nil
+}
+
+func readFrame(r io.Reader, max uint32) ([]byte, error) {
+	size, err := readFrameSize(r, max)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// readPayload reads a frame directly in a locked buffer, returns nil for an empty frame
+func readPayload(r io.Reader) (*memguard.LockedBuffer, error) {
+	size, err := readFrameSize(r, maxPayloadSize)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buffer, err := memguard.NewBufferFromReader(r, int(size))
+	if err != nil {
+		buffer.Destroy()
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func writePayload(w io.Writer, payload *memguard.LockedBuffer) error {
+	if payload == nil {
+		return writeFrame(w, nil)
+	}
+	return writeFrame(w, payload.Bytes())
+}
+
+/////////////////////
+
+// textPayloadCommands lists the commands of the text protocol directly followed by a secret, up to a new line
+var textPayloadCommands = map[string]bool{
+	"set_secret": true,
+}
+
+// textCodec is the historical protocol, byte for byte: a command word, ended by a space or a new line,
+// followed by the secret for set_secret. It has no arguments, commands always target DefaultSecretName
+// and named secrets are only reachable with the framed protocol.
+type textCodec struct {
+	reader io.Reader
+	writer io.Writer
+}
+
+func (c *textCodec) Version() int {
+	return ProtocolText
+}
+
+func (c *textCodec) ReadRequest() (*request, error) {
+	command, _, err := readWord(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	req := &request{Command: command}
+
+	if textPayloadCommands[command] {
+		buffer, err := memguard.NewBufferFromReaderUntil(c.reader, '\n')
+		if err != nil && err != io.EOF {
+			buffer.Destroy()
+			return nil, errs.WithE(err, "Failed to read secret from connection")
+		}
+		req.Payload = buffer
+	}
+	return req, nil
+}
+
+// WriteResponse writes nothing on error, the text protocol has no status and the connection is closed.
+// A response without value nor payload, like set_secret, writes nothing either.
+func (c *textCodec) WriteResponse(resp *response) error {
+	if resp.Status != StatusOK || (resp.Payload == nil && resp.Values == nil) {
+		return nil
+	}
+	if resp.Payload != nil {
+		defer resp.Payload.Destroy()
+		if err := WriteBytes(c.writer, resp.Payload.Bytes()); err != nil {
+			return err
+		}
+		return WriteBytes(c.writer, []byte{'\n'})
+	}
+
+	for _, value := range resp.Values {
+		if err := WriteBytes(c.writer, []byte(value+"\n")); err != nil {
+			return err
+		}
+	}
+	return WriteBytes(c.writer, []byte{'\n'})
+}
@@ -0,0 +1,147 @@
+package memguarded
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate_TextProtocolWithoutHandshake(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	out := &bytes.Buffer{}
+	conn := &fakeConn{Reader: bytes.NewBufferString("set_secret hunter2\nget_secret\n"), Writer: out}
+
+	codec, err := negotiate(conn, []string{"get_secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolText, codec.Version())
+
+	req, err := codec.ReadRequest()
+	assert.NoError(t, err)
+	assert.Equal(t, "set_secret", req.Command)
+	assert.Empty(t, req.Args)
+	assert.Equal(t, DefaultSecretName, req.name())
+	assert.Equal(t, []byte("hunter2"), req.Payload.Bytes())
+	req.destroy()
+
+	req, err = codec.ReadRequest()
+	assert.NoError(t, err)
+	assert.Equal(t, "get_secret", req.Command)
+	assert.Equal(t, DefaultSecretName, req.name())
+	assert.Nil(t, req.Payload)
+
+	assert.NoError(t, codec.WriteResponse(&response{Payload: memguard.NewBufferFromBytes([]byte("hunter2"))}))
+	assert.Equal(t, "hunter2\n", out.String())
+}
+
+func TestServer_TextProtocolSetsDefaultSecret(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	store := NewStore()
+	var s Server
+	assert.NoError(t, s.InitStore(store))
+
+	out := &bytes.Buffer{}
+	conn := &fakeConn{Reader: bytes.NewBufferString("set_secret hunter2\nget_secret\n"), Writer: out}
+	codec, err := negotiate(conn, s.commandNames())
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		req, err := codec.ReadRequest()
+		assert.NoError(t, err)
+		assert.NoError(t, codec.WriteResponse(s.handleRequest(req, nil)))
+	}
+
+	assert.Equal(t, []string{DefaultSecretName}, store.Names())
+	assert.Equal(t, "hunter2\n", out.String())
+}
+
+func TestNegotiate_TextProtocolDefaultName(t *testing.T) {
+	conn := &fakeConn{Reader: bytes.NewBufferString("get_secret\n"), Writer: &bytes.Buffer{}}
+
+	codec, err := negotiate(conn, nil)
+	assert.NoError(t, err)
+
+	req, err := codec.ReadRequest()
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultSecretName, req.name())
+}
+
+func TestNegotiate_FramedProtocol(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	toServer := &bytes.Buffer{}
+	toClient := &bytes.Buffer{}
+	client := &fakeConn{Reader: toClient, Writer: toServer}
+	server := &fakeConn{Reader: toServer, Writer: toClient}
+
+	// handshake is written before the server reads it, buffers are not blocking
+	assert.NoError(t, WriteBytes(toServer, append(append([]byte{}, protocolMagic...), 9)))
+	codec, err := negotiate(server, []string{"get_secret", "set_secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolFramed, codec.Version())
+
+	toServer.Reset()
+	version, capabilities, err := clientHandshake(client)
+	assert.NoError(t, err)
+	assert.Equal(t, ProtocolFramed, version)
+	assert.Equal(t, []string{"get_secret", "set_secret"}, capabilities)
+
+	secret := memguard.NewBufferFromBytes([]byte("multi\nline\x00secret"))
+	defer secret.Destroy()
+	toServer.Reset()
+	assert.NoError(t, writeRequest(toServer, "set_secret", []string{"db"}, secret))
+
+	req, err := codec.ReadRequest()
+	assert.NoError(t, err)
+	assert.Equal(t, "set_secret", req.Command)
+	assert.Equal(t, []string{"db"}, req.Args)
+	assert.Equal(t, []byte("multi\nline\x00secret"), req.Payload.Bytes())
+
+	assert.NoError(t, codec.WriteResponse(&response{Values: []string{"a", "b"}, Payload: req.Payload}))
+	values, payload, err := readResponse(client)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, values)
+	assert.Equal(t, []byte("multi\nline\x00secret"), payload.Bytes())
+	payload.Destroy()
+}
+
+func TestReadFrame_TooLarge(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, writeFrame(buf, make([]byte, 10)))
+
+	_, err := readFrame(buf, 5)
+	assert.Error(t, err)
+}
+
+func TestReadPayload_Empty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, writePayload(buf, nil))
+
+	payload, err := readPayload(buf)
+	assert.NoError(t, err)
+	assert.Nil(t, payload)
+}
+
+func TestReadResponse_StatusError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	codec := &framedCodec{conn: buf, version: ProtocolFramed}
+
+	resp := errorResponse(errs.WithE(newStatusError(StatusNotSet, "Secret is not set"), "wrapped"))
+	assert.NoError(t, codec.WriteResponse(resp))
+
+	_, payload, err := readResponse(buf)
+	assert.Nil(t, payload)
+	assert.True(t, errors.Is(err, ErrSecretNotSet))
+	assert.False(t, errors.Is(err, ErrUnauthorized))
+	assert.Equal(t, "NOT_SET: Secret is not set", err.Error())
+}
+
+func TestStatusOf_InternalByDefault(t *testing.T) {
+	status := statusOf(errs.With("boom"))
+	assert.Equal(t, StatusInternal, status.Status)
+	assert.NotContains(t, status.Message, "boom")
+}
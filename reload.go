@@ -0,0 +1,149 @@
+package memguarded
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"time"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// tlsMaterial is the server certificate, client CA pool and revocations, replaced as a whole on reload
+type tlsMaterial struct {
+	certificate tls.Certificate
+	clientCAs   *x509.CertPool
+	revocations *RevocationList
+	stamps      map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Reload loads the certificate, key, CA and revocation files again, used by new connections only.
+// When they fail to load, the error is logged and returned and the current material is kept.
+func (s *Server) Reload() error {
+	material, err := s.loadTLSMaterial()
+	if err != nil {
+		logs.WithE(err).Error("Failed to reload certificates, keeping current ones")
+		return err
+	}
+	s.material.Store(material)
+	logs.WithField("cert", s.CertPem).Info("Certificates reloaded")
+	return nil
+}
+
+func (s *Server) loadTLSMaterial() (*tlsMaterial, error) {
+	material := &tlsMaterial{stamps: s.fileStamps()}
+
+	var err error
+	material.certificate, err = loadX509KeyPair(s.CertPem, s.CertKey, s.CertPassphrase)
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to load server key")
+	}
+
+	material.clientCAs = x509.NewCertPool()
+	caPem, err := os.ReadFile(s.CAPem)
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to read client CA certificate authority")
+	}
+	if !material.clientCAs.AppendCertsFromPEM(caPem) {
+		return nil, errs.WithF(data.WithField("file", s.CAPem), "Failed to parse client CA certificate authority")
+	}
+
+	if s.RevocationFile != "" {
+		cas, err := parseCertificates(caPem)
+		if err != nil {
+			return nil, errs.WithEF(err, data.WithField("file", s.CAPem), "Failed to parse client CA certificate authority")
+		}
+		if material.revocations, err = LoadRevocationList(s.RevocationFile, cas); err != nil {
+			return nil, err
+		}
+	}
+	return material, nil
+}
+
+// tlsConfig serves each handshake with the material loaded at that time
+func (s *Server) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			material := s.material.Load()
+			return &tls.Config{
+				Certificates: []tls.Certificate{material.certificate},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    material.clientCAs,
+				Rand:         rand.Reader,
+			}, nil
+		},
+	}
+}
+
+func parseCertificates(content []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+func (s *Server) fileStamps() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, file := range []string{s.CertPem, s.CertKey, s.CAPem, s.RevocationFile} {
+		if stat, err := os.Stat(file); err == nil {
+			stamps[file] = fileStamp{modTime: stat.ModTime(), size: stat.Size()}
+		}
+	}
+	return stamps
+}
+
+// watchFiles reloads when a file changed since the last attempt, until the server stops
+func (s *Server) watchFiles(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	attempted := s.material.Load().stamps
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		stamps := s.fileStamps()
+		if sameStamps(stamps, attempted) {
+			continue
+		}
+		attempted = stamps
+		_ = s.Reload()
+	}
+}
+
+func sameStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, stamp := range a {
+		other, ok := b[file]
+		if !ok || !other.modTime.Equal(stamp.modTime) || other.size != stamp.size {
+			return false
+		}
+	}
+	return true
+}
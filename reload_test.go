@@ -0,0 +1,92 @@
+package memguarded
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func copyTestFile(t *testing.T, from, to string) {
+	content, err := os.ReadFile(from)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(to, content, 0600))
+}
+
+// rotateTestPKI replaces the files of p by the ones of next
+func rotateTestPKI(t *testing.T, p *testPKI, next *testPKI) {
+	copyTestFile(t, next.ServerPem, p.ServerPem)
+	copyTestFile(t, next.ServerKey, p.ServerKey)
+	copyTestFile(t, next.CAPem, p.CAPem)
+}
+
+func TestServer_ReloadKeepsSecrets(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	store := NewStore()
+	server := startTestServer(t, pki, store)
+	secret := []byte("s3cret")
+	require.NoError(t, store.Service(DefaultSecretName).FromBytes(&secret))
+
+	next := newTestPKI(t)
+	rotateTestPKI(t, pki, next)
+	require.NoError(t, server.Reload())
+
+	assert.Error(t, testClient(pki, server).Connect(), "the old client CA is not trusted anymore")
+	client := testClient(next, server)
+	client.CAPem = next.CAPem
+	require.NoError(t, client.Connect())
+	defer client.Close()
+
+	got := NewService()
+	require.NoError(t, client.GetSecret(got))
+	buffer, err := got.Get()
+	require.NoError(t, err)
+	defer buffer.Destroy()
+	assert.Equal(t, "s3cret", string(buffer.Bytes()))
+}
+
+func TestServer_ReloadFailureKeepsCurrent(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	server := startTestServer(t, pki, NewStore())
+
+	require.NoError(t, os.WriteFile(pki.ServerPem, []byte("not a certificate"), 0600))
+	assert.Error(t, server.Reload())
+
+	client := testClient(pki, server)
+	require.NoError(t, client.Connect())
+	client.Close()
+}
+
+func TestServer_ReloadOnFileChange(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	server := runTestServer(t, &Server{
+		SocketPath:     filepath.Join(pki.Dir, "test.sock"),
+		CertPem:        pki.ServerPem,
+		CertKey:        pki.ServerKey,
+		CAPem:          pki.CAPem,
+		ReloadInterval: 10 * time.Millisecond,
+	}, NewStore())
+
+	next := newTestPKI(t)
+	rotateTestPKI(t, pki, next)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		client := testClient(next, server)
+		client.CAPem = next.CAPem
+		if err := client.Connect(); err == nil {
+			client.Close()
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "certificates not reloaded")
+	}
+}
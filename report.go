@@ -0,0 +1,83 @@
+package memguarded
+
+import (
+	"math"
+	"time"
+)
+
+// StatusReport is the state of the server returned by the status command, without any secret value
+type StatusReport struct {
+	Version       string         `json:"version,omitempty"`
+	Protocol      int            `json:"protocol"`
+	StartedAt     time.Time      `json:"startedAt"`
+	UptimeSeconds int64          `json:"uptimeSeconds"`
+	Sealed        *bool          `json:"sealed,omitempty"` // only with a snapshot
+	Shares        *SharesStatus  `json:"shares,omitempty"` // only with a shamir threshold
+	Secrets       []SecretStatus `json:"secrets"`
+}
+
+type SharesStatus struct {
+	Received  int `json:"received"`
+	Threshold int `json:"threshold"`
+}
+
+// SecretStatus describes a secret known by the server, set or not
+type SecretStatus struct {
+	Name       string    `json:"name"`
+	Set        bool      `json:"set"`
+	Size       int       `json:"size"`
+	Version    uint64    `json:"version"`
+	SetAt      time.Time `json:"setAt,omitzero"`
+	LastAccess time.Time `json:"lastAccess,omitzero"`
+	Gets       uint64    `json:"gets"`
+	// ExpiresAt is the earliest of the ttl and idle ttl expirations, zero if the secret does not expire
+	ExpiresAt           time.Time `json:"expiresAt,omitzero"`
+	TTLRemainingSeconds int64     `json:"ttlRemainingSeconds,omitempty"`
+}
+
+// report returns the status of the server and of the secrets of store
+func (s *Server) report(store *Store) StatusReport {
+	report := StatusReport{
+		Version:       s.Version,
+		Protocol:      ProtocolVersion,
+		StartedAt:     s.startedAt,
+		UptimeSeconds: int64(time.Since(s.startedAt) / time.Second),
+		Secrets:       []SecretStatus{},
+	}
+	if s.Snapshot != nil {
+		sealed := s.Snapshot.Sealed()
+		report.Sealed = &sealed
+	}
+	if s.Shares != nil {
+		received, threshold := s.Shares.Progress()
+		report.Shares = &SharesStatus{Received: received, Threshold: threshold}
+	}
+	store.each(func(name string, service *Service) {
+		report.Secrets = append(report.Secrets, service.status(name))
+	})
+	return report
+}
+
+// status describes the secret, without counting it as a read
+func (s *Service) status(name string) SecretStatus {
+	s.secretLock.RLock()
+	defer s.secretLock.RUnlock()
+
+	status := SecretStatus{
+		Name:    name,
+		Set:     s.secret != nil,
+		Version: s.version,
+		SetAt:   s.setAt,
+		Gets:    s.gets,
+	}
+	if s.secret == nil {
+		return status
+	}
+	status.Size = s.secret.Size()
+	status.LastAccess = s.lastAccess
+	if at, ok := s.expiresAt(); ok {
+		status.ExpiresAt = at
+		status.TTLRemainingSeconds = int64(math.Ceil(time.Until(at).Seconds()))
+	}
+	return status
+}
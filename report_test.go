@@ -0,0 +1,83 @@
+package memguarded
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_StatusDoesNotCountAsRead(t *testing.T) {
+	service := NewService()
+	assert.Equal(t, SecretStatus{Name: "db"}, service.status("db"))
+
+	service.SetIdleTTL(time.Hour)
+	setTestSecret(t, service, "s3cret")
+	getTestSecret(t, service)
+	getTestSecret(t, service)
+
+	status := service.status("db")
+	assert.True(t, status.Set)
+	assert.Equal(t, 6, status.Size)
+	assert.Equal(t, uint64(1), status.Version)
+	assert.Equal(t, uint64(2), status.Gets)
+	assert.Equal(t, int64(3600), status.TTLRemainingSeconds)
+	assert.Equal(t, status.LastAccess.Add(time.Hour), status.ExpiresAt)
+	assert.Equal(t, uint64(2), service.status("db").Gets)
+}
+
+func TestServer_Status(t *testing.T) {
+	pki := newTestPKI(t)
+	store := NewStore()
+	setTestSecret(t, store.Service("db"), "s3cret")
+	store.Service("empty")
+	server := runTestServer(t, &Server{
+		SocketPath: filepath.Join(pki.Dir, "status.sock"),
+		CertPem:    pki.ServerPem,
+		CertKey:    pki.ServerKey,
+		CAPem:      pki.CAPem,
+		Version:    "1.2.3",
+	}, store)
+	client := newTestClient(t, pki, server)
+
+	require.NoError(t, client.GetNamedSecret("db", NewService()))
+	report, err := client.Status()
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3", report.Version)
+	assert.Equal(t, ProtocolVersion, report.Protocol)
+	assert.False(t, report.StartedAt.IsZero())
+	assert.Nil(t, report.Sealed)
+	assert.Nil(t, report.Shares)
+	require.Len(t, report.Secrets, 2)
+	assert.Equal(t, "db", report.Secrets[0].Name)
+	assert.True(t, report.Secrets[0].Set)
+	assert.Equal(t, 6, report.Secrets[0].Size)
+	assert.Equal(t, uint64(1), report.Secrets[0].Gets)
+	assert.Equal(t, SecretStatus{Name: "empty"}, report.Secrets[1])
+}
+
+func TestServer_StatusLargerThanAFrame(t *testing.T) {
+	pki := newTestPKI(t)
+	store := NewStore()
+	for i := 0; i < 100; i++ {
+		setTestSecret(t, store.Service(fmt.Sprintf("secret-with-a-long-name-%03d", i)), "s3cret")
+	}
+	server := runTestServer(t, &Server{
+		SocketPath: filepath.Join(pki.Dir, "large.sock"),
+		CertPem:    pki.ServerPem,
+		CertKey:    pki.ServerKey,
+		CAPem:      pki.CAPem,
+	}, store)
+	client := newTestClient(t, pki, server)
+
+	report, err := client.Status()
+	require.NoError(t, err)
+	assert.Len(t, report.Secrets, 100)
+	encoded, err := json.Marshal(report)
+	require.NoError(t, err)
+	assert.True(t, len(encoded) > maxFrameSize)
+}
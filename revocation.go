@@ -0,0 +1,165 @@
+package memguarded
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// RevocationList denies client certificates by serial number or public key fingerprint.
+// It is loaded from PEM encoded CRLs signed by a client CA, or from a denylist like:
+//
+//	# client revoked on 2024-01-02
+//	serial 5f0e1c...
+//	spki 3a7bd3e2360a3d...
+type RevocationList struct {
+	serials map[string]struct{}
+	spkis   map[string]struct{}
+	crls    []*x509.RevocationList
+}
+
+// LoadRevocationList reads file, CRLs must be signed by one of cas
+func LoadRevocationList(file string, cas []*x509.Certificate) (*RevocationList, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("file", file), "Failed to read revocation list")
+	}
+	list, err := parseRevocationList(content, cas)
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("file", file), "Failed to parse revocation list")
+	}
+	return list, nil
+}
+
+func parseRevocationList(content []byte, cas []*x509.Certificate) (*RevocationList, error) {
+	list := &RevocationList{
+		serials: make(map[string]struct{}),
+		spkis:   make(map[string]struct{}),
+	}
+
+	if bytes.Contains(content, []byte("-----BEGIN X509 CRL-----")) {
+		for {
+			var block *pem.Block
+			block, content = pem.Decode(content)
+			if block == nil {
+				return list, nil
+			}
+			if block.Type != "X509 CRL" {
+				continue
+			}
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				return nil, errs.WithE(err, "Failed to parse CRL")
+			}
+			if err := checkCRLSignature(crl, cas); err != nil {
+				return nil, err
+			}
+			list.crls = append(list.crls, crl)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errs.WithF(data.WithField("line", i), "Expected '<serial|spki> <hex>'")
+		}
+		switch fields[0] {
+		case "serial":
+			serial, ok := new(big.Int).SetString(strings.ReplaceAll(fields[1], ":", ""), 16)
+			if !ok {
+				return nil, errs.WithF(data.WithField("line", i).WithField("serial", fields[1]), "Invalid serial number")
+			}
+			list.serials[serialKey(serial)] = struct{}{}
+		case "spki":
+			list.spkis[strings.ToLower(fields[1])] = struct{}{}
+		default:
+			return nil, errs.WithF(data.WithField("line", i).WithField("kind", fields[0]), "Unknown revocation kind")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errs.WithE(err, "Failed to read revocation list")
+	}
+	return list, nil
+}
+
+func checkCRLSignature(crl *x509.RevocationList, cas []*x509.Certificate) error {
+	for _, ca := range cas {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return errs.WithF(data.WithField("issuer", crl.Issuer.String()), "CRL is not signed by a client CA")
+}
+
+// Revoked returns true if cert is denied, a nil list revokes nothing
+func (r *RevocationList) Revoked(cert *x509.Certificate) bool {
+	if r == nil {
+		return false
+	}
+	if _, ok := r.serials[serialKey(cert.SerialNumber)]; ok {
+		return true
+	}
+	if _, ok := r.spkis[spkiSha256(cert)]; ok {
+		return true
+	}
+	for _, crl := range r.crls {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) {
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AppendRevocation adds the serial number of cert to the denylist file, creating it if needed
+func AppendRevocation(file string, cert *x509.Certificate) error {
+	content, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return errs.WithEF(err, data.WithField("file", file), "Failed to read revocation list")
+	}
+	list, err := parseRevocationList(content, nil)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", file), "Failed to parse revocation list")
+	}
+	if list.Revoked(cert) {
+		logs.WithField("serial", serialKey(cert.SerialNumber)).Info("Certificate is already revoked")
+		return nil
+	}
+
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", file), "Failed to open revocation list")
+	}
+	entry := "# " + strconv.Quote(cert.Subject.CommonName) + "\nserial " + serialKey(cert.SerialNumber) + "\n"
+	if _, err := out.WriteString(entry); err != nil {
+		out.Close()
+		return errs.WithEF(err, data.WithField("file", file), "Failed to write revocation list")
+	}
+	if err := out.Close(); err != nil {
+		return errs.WithEF(err, data.WithField("file", file), "Failed to close revocation list")
+	}
+	return nil
+}
+
+func serialKey(serial *big.Int) string {
+	return serial.Text(16)
+}
@@ -0,0 +1,124 @@
+package memguarded
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationList_Denylist(t *testing.T) {
+	pki := newTestPKI(t)
+	revoked := pki.issue(t, filepath.Join(pki.Dir, "a.pem"), filepath.Join(pki.Dir, "a.key"), "a", x509.ExtKeyUsageClientAuth)
+	bySpki := pki.issue(t, filepath.Join(pki.Dir, "b.pem"), filepath.Join(pki.Dir, "b.key"), "b", x509.ExtKeyUsageClientAuth)
+	allowed := pki.issue(t, filepath.Join(pki.Dir, "c.pem"), filepath.Join(pki.Dir, "c.key"), "c", x509.ExtKeyUsageClientAuth)
+
+	list, err := parseRevocationList([]byte(`
+# comment
+serial `+strings.ToUpper(revoked.SerialNumber.Text(16))+`
+spki `+spkiSha256(bySpki)+`
+`), nil)
+	require.NoError(t, err)
+	assert.True(t, list.Revoked(revoked))
+	assert.True(t, list.Revoked(bySpki))
+	assert.False(t, list.Revoked(allowed))
+
+	var none *RevocationList
+	assert.False(t, none.Revoked(revoked))
+
+	for _, invalid := range []string{"serial", "serial zz", "fingerprint 00", "serial 01 02"} {
+		_, err := parseRevocationList([]byte(invalid), nil)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRevocationList_CRL(t *testing.T) {
+	pki := newTestPKI(t)
+	revoked := pki.issue(t, filepath.Join(pki.Dir, "a.pem"), filepath.Join(pki.Dir, "a.key"), "a", x509.ExtKeyUsageClientAuth)
+	allowed := pki.issue(t, filepath.Join(pki.Dir, "b.pem"), filepath.Join(pki.Dir, "b.key"), "b", x509.ExtKeyUsageClientAuth)
+
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, pki.caCert, pki.caKey)
+	require.NoError(t, err)
+	crlPem := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})
+
+	list, err := parseRevocationList(crlPem, []*x509.Certificate{pki.caCert})
+	require.NoError(t, err)
+	assert.True(t, list.Revoked(revoked))
+	assert.False(t, list.Revoked(allowed))
+
+	other := newTestPKI(t)
+	_, err = parseRevocationList(crlPem, []*x509.Certificate{other.caCert})
+	assert.Error(t, err)
+}
+
+func TestServer_RefusesRevokedClient(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	revocationFile := filepath.Join(pki.Dir, "revoked.list")
+	require.NoError(t, os.WriteFile(revocationFile, nil, 0644))
+	server := runTestServer(t, &Server{
+		SocketPath:     filepath.Join(pki.Dir, "test.sock"),
+		CertPem:        pki.ServerPem,
+		CertKey:        pki.ServerKey,
+		CAPem:          pki.CAPem,
+		RevocationFile: revocationFile,
+	}, NewStore())
+
+	client := testClient(pki, server)
+	require.NoError(t, client.Connect())
+	client.Close()
+
+	revoked, err := parseCertificates(mustReadFile(t, pki.ClientPem))
+	require.NoError(t, err)
+	require.NoError(t, AppendRevocation(revocationFile, revoked[0]))
+	require.NoError(t, AppendRevocation(revocationFile, revoked[0]))
+	assert.Equal(t, 1, strings.Count(string(mustReadFile(t, revocationFile)), "serial "))
+	require.NoError(t, server.Reload())
+
+	assert.Error(t, testClient(pki, server).Connect())
+
+	other := &testPKI{CAPem: pki.CAPem, ClientPem: filepath.Join(pki.Dir, "other.pem"), ClientKey: filepath.Join(pki.Dir, "other.key")}
+	pki.issue(t, other.ClientPem, other.ClientKey, "other", x509.ExtKeyUsageClientAuth)
+	client = testClient(other, server)
+	require.NoError(t, client.Connect())
+	client.Close()
+}
+
+func TestPKI_Revoke(t *testing.T) {
+	pki := &PKI{Dir: t.TempDir(), KeyType: KeyTypeEd25519}
+	caPassphrase := testPassphrase("ca passphrase")
+	require.NoError(t, pki.Init(caPassphrase, "test ca"))
+	require.NoError(t, pki.IssueClient(caPassphrase, nil, "client", "test client"))
+
+	require.NoError(t, pki.Revoke("client"))
+	cas, err := parseCertificates(mustReadFile(t, pki.Path("ca", ".pem")))
+	require.NoError(t, err)
+	list, err := LoadRevocationList(pki.RevocationFile(), cas)
+	require.NoError(t, err)
+	assert.True(t, list.Revoked(readTestCertificate(t, pki.Path("client", ".pem"))))
+
+	assert.Error(t, pki.Revoke("unknown"))
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return content
+}
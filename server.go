@@ -1,20 +1,25 @@
 package memguarded
 
 import (
-	"crypto/rand"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
 	"os/user"
-	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
-	"unsafe"
 
+	"github.com/awnumar/memguard"
 	"github.com/n0rad/go-erlog/data"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
@@ -22,36 +27,304 @@ import (
 
 type Server struct {
 	Timeout              time.Duration
+	MaxConnections       int
+	DefaultTTL           time.Duration
+	MaxTTL               time.Duration
+	MaxWait              time.Duration
+	MaxWaiters           int // connections blocked in wait_secret, out of the MaxConnections pool, 256 if not set
 	SocketPath           string
 	StopOnAnyClientError bool
 	CertKey              string
 	CertPem              string
 	CAPem                string
+	CertPassphrase       *Service // unlocks CertKey when encrypted, kept for reloads
+	Policy               *Policy
+	ReloadInterval       time.Duration // checks certificate files for changes, 0 to only reload on Reload
+	RevocationFile       string        // CRLs or denylist of revoked client certificates
+	Snapshot             *Snapshot     // adds the unseal command restoring the secrets of the snapshot
+	Shares               *Shares       // adds the submit_share command, each share from a different client certificate
+	RotationGrace        time.Duration // previous version readable after rotate_secret without grace option, 1h if not set
+	Version              string        // reported by the status command
+	Audit                *AuditLog     // records every connection and command, opened by the caller
+
+	material    atomic.Pointer[tlsMaterial]
+	startedAt   time.Time
+	userUid     uint32
+	commands    map[string]commandFunc
+	waiters     chan struct{}
+	stop        chan struct{}
+	stopOnce    sync.Once
+	listener    net.Listener
+	lock        sync.Mutex
+	connections sync.WaitGroup
+}
+
+// secretCommands lists the commands whose first argument is a secret name
+var secretCommands = map[string]bool{
+	"set_secret":      true,
+	"get_secret":      true,
+	"wait_secret":     true,
+	"clear_secret":    true,
+	"delete_secret":   true,
+	"rotate_secret":   true,
+	"secret_versions": true,
+}
+
+// clientInfo identifies the client of a connection, any part can be unknown
+type clientInfo struct {
+	Peer        *PeerInfo
+	Certificate *x509.Certificate
+}
+
+func (c *clientInfo) fields() data.Fields {
+	if c == nil {
+		return data.WithField("client", "unknown")
+	}
+	fields := c.Peer.fields()
+	if c.Certificate != nil {
+		fields = fields.WithField("subject", c.Certificate.Subject.String()).
+			WithField("spki", spkiSha256(c.Certificate))
+	}
+	return fields
+}
+
+// identity names the client as setter of a secret version
+func (c *clientInfo) identity() string {
+	switch {
+	case c == nil:
+		return ""
+	case c.Certificate != nil:
+		return "cn=" + c.Certificate.Subject.CommonName
+	case c.Peer != nil:
+		return "uid=" + strconv.FormatUint(uint64(c.Peer.Uid), 10) + " exe=" + c.Peer.Exe
+	}
+	return ""
+}
+
+// auditRecord starts a record of event with what is known of the client
+func (c *clientInfo) auditRecord(event string) AuditRecord {
+	record := AuditRecord{Event: event}
+	if c == nil {
+		return record
+	}
+	if c.Peer != nil {
+		record.Peer = &AuditPeer{Uid: c.Peer.Uid, Gid: c.Peer.Gid, Pid: c.Peer.Pid, Exe: c.Peer.Exe}
+	}
+	if c.Certificate != nil {
+		sum := sha256.Sum256(c.Certificate.Raw)
+		record.Subject = c.Certificate.Subject.String()
+		record.Fingerprint = hex.EncodeToString(sum[:])
+		record.Spki = spkiSha256(c.Certificate)
+	}
+	return record
+}
 
-	userUid  uint32
-	commands map[string]func(net.Conn) error
-	stop     chan struct{}
-	listener net.Listener
+// auditMessage is the message of err, without the fields and causes logged by the server
+func auditMessage(err error) string {
+	if e, ok := err.(*errs.EntryError); ok {
+		return e.Message
+	}
+	return err.Error()
 }
 
+// commandFunc handles a request, its payload is destroyed once it returns
+type commandFunc func(req *request) (*response, error)
+
+// Init serves the single secretService as the DefaultSecretName secret
 func (s *Server) Init(secretService *Service) error {
+	store := NewStore()
+	store.Register(DefaultSecretName, secretService)
+	return s.InitStore(store)
+}
+
+// InitStore serves the secrets of store, named by the clients
+func (s *Server) InitStore(store *Store) error {
 	s.Timeout = 10 * time.Second
-	s.commands = make(map[string]func(net.Conn) error)
+	if s.MaxConnections <= 0 {
+		s.MaxConnections = 16
+	}
+	if s.MaxWait <= 0 {
+		s.MaxWait = time.Hour
+	}
+	if s.MaxWaiters <= 0 {
+		s.MaxWaiters = 256
+	}
+	if s.RotationGrace <= 0 {
+		s.RotationGrace = time.Hour
+	}
+	s.waiters = make(chan struct{}, s.MaxWaiters)
+	s.stop = make(chan struct{})
+	s.commands = make(map[string]commandFunc)
 
-	s.commands["set_secret"] = func(m net.Conn) error {
-		logs.Info("Set secret")
-		if err := secretService.FromReaderUntilNewLine(m); err != nil {
-			return err
+	s.commands["set_secret"] = func(req *request) (*response, error) {
+		logs.WithF(data.WithField("name", req.name())).Info("Set secret")
+		options, err := parseOptions(req.Args)
+		if err != nil {
+			return nil, err
 		}
-		return nil
+		ttl, err := s.ttlOption(options)
+		if err != nil {
+			return nil, err
+		}
+		idleTTL, err := durationOption(options, "idle-ttl", 0)
+		if err != nil {
+			return nil, err
+		}
+		if !req.hasPayload() {
+			return nil, newStatusError(StatusInvalidArgument, "Secret is required")
+		}
+
+		service := store.Service(req.name())
+		service.SetTTL(ttl)
+		service.SetIdleTTL(idleTTL)
+		service.replace(req.Payload, req.client.identity(), 0, EventSet)
+		return &response{}, nil
 	}
-	s.commands["get_secret"] = func(m net.Conn) error {
-		logs.Info("Get secret")
-		err := secretService.Write(m)
+	s.commands["rotate_secret"] = func(req *request) (*response, error) {
+		logs.WithF(data.WithField("name", req.name())).Info("Rotate secret")
+		options, err := parseOptions(req.Args)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		grace := s.RotationGrace
+		if value, ok := options["grace"]; ok {
+			if grace, err = time.ParseDuration(value); err != nil || grace < 0 {
+				return nil, newStatusError(StatusInvalidArgument, "Invalid grace option "+value)
+			}
+		}
+		ttl, err := s.ttlOption(options)
+		if err != nil {
+			return nil, err
+		}
+		idleTTL, err := durationOption(options, "idle-ttl", 0)
+		if err != nil {
+			return nil, err
+		}
+		if !req.hasPayload() {
+			return nil, newStatusError(StatusInvalidArgument, "New secret is required")
+		}
+
+		service := store.Service(req.name())
+		service.SetTTL(ttl)
+		service.SetIdleTTL(idleTTL)
+		service.Rotate(req.Payload, req.client.identity(), grace)
+		return &response{Values: []string{strconv.FormatUint(service.Version(), 10)}}, nil
+	}
+	s.commands["get_secret"] = func(req *request) (*response, error) {
+		logs.WithF(data.WithField("name", req.name())).Info("Get secret")
+		options, err := parseOptions(req.Args)
+		if err != nil {
+			return nil, err
+		}
+		service, ok := store.Lookup(req.name())
+		if !ok {
+			return nil, errs.WithEF(ErrSecretNotSet, data.WithField("name", req.name()), "Secret is not set")
+		}
+		var buffer *memguard.LockedBuffer
+		if value, ok := options["version"]; ok {
+			version, parseErr := strconv.ParseUint(value, 10, 64)
+			if parseErr != nil {
+				return nil, newStatusError(StatusInvalidArgument, "Invalid version option "+value)
+			}
+			buffer, err = service.GetVersion(version)
+		} else {
+			buffer, err = service.Get()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &response{Payload: buffer}, nil
+	}
+	s.commands["secret_versions"] = func(req *request) (*response, error) {
+		logs.WithF(data.WithField("name", req.name())).Info("Secret versions")
+		service, ok := store.Lookup(req.name())
+		if !ok {
+			return nil, errs.WithEF(ErrSecretNotSet, data.WithField("name", req.name()), "Secret is not set")
+		}
+		values := []string{}
+		for _, version := range service.Versions() {
+			value, err := json.Marshal(version)
+			if err != nil {
+				return nil, errs.WithE(err, "Failed to marshal version")
+			}
+			values = append(values, string(value))
+		}
+		return &response{Values: values}, nil
+	}
+	s.commands["wait_secret"] = func(req *request) (*response, error) {
+		logs.WithF(data.WithField("name", req.name())).Info("Wait secret")
+		options, err := parseOptions(req.Args)
+		if err != nil {
+			return nil, err
+		}
+		timeout := s.MaxWait
+		if value, ok := options["timeout"]; ok {
+			if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+				return nil, newStatusError(StatusInvalidArgument, "Invalid timeout option "+value)
+			}
+			if timeout > s.MaxWait {
+				timeout = s.MaxWait
+			}
+		}
+		return s.waitSecret(req, store, timeout)
+	}
+	s.commands["list_secrets"] = func(req *request) (*response, error) {
+		logs.Info("List secrets")
+		return &response{Values: store.Names()}, nil
+	}
+	s.commands["clear_secret"] = func(req *request) (*response, error) {
+		logs.WithF(data.WithField("name", req.name())).Info("Clear secret")
+		if service, ok := store.Lookup(req.name()); ok {
+			service.Clear()
+		}
+		return &response{}, nil
+	}
+	s.commands["delete_secret"] = func(req *request) (*response, error) {
+		logs.WithF(data.WithField("name", req.name())).Info("Delete secret")
+		store.Delete(req.name())
+		return &response{}, nil
+	}
+	if s.Snapshot != nil {
+		s.commands["unseal"] = func(req *request) (*response, error) {
+			logs.Info("Unseal snapshot")
+			options, err := parseOptions(append([]string{""}, req.Args...))
+			if err != nil {
+				return nil, err
+			}
+			if req.Payload == nil {
+				return nil, newStatusError(StatusInvalidArgument, "Passphrase is required")
+			}
+			restored, err := s.Snapshot.Unseal(req.Payload, options["create"] == "true")
+			if err != nil {
+				return nil, err
+			}
+			return &response{Values: []string{strconv.Itoa(restored)}}, nil
+		}
+	}
+	if s.Shares != nil {
+		s.commands["submit_share"] = func(req *request) (*response, error) {
+			if req.client == nil || req.client.Certificate == nil {
+				return nil, newStatusError(StatusUnauthorized, "A client certificate is required to submit a share")
+			}
+			logs.WithF(req.client.fields()).Info("Submit share")
+			if req.Payload == nil {
+				return nil, newStatusError(StatusInvalidArgument, "Share is required")
+			}
+			received, err := s.Shares.Submit(req.Payload, spkiSha256(req.client.Certificate))
+			if err != nil {
+				return nil, err
+			}
+			return &response{Values: []string{strconv.Itoa(received), strconv.Itoa(s.Shares.Threshold)}}, nil
 		}
-		return WriteBytes(m, []byte{'\n'})
+	}
+	s.commands["status"] = func(req *request) (*response, error) {
+		logs.Debug("Status")
+		report, err := json.Marshal(s.report(store))
+		if err != nil {
+			return nil, errs.WithE(err, "Failed to marshal status")
+		}
+		// in the payload, value frames are too small for the report of many secrets
+		return &response{Payload: memguard.NewBufferFromBytes(report)}, nil
 	}
 
 	uidStr, err := user.Current()
@@ -69,43 +342,45 @@ func (s *Server) Init(secretService *Service) error {
 }
 
 func (s *Server) Start() error {
+	s.startedAt = time.Now()
 	s.cleanupSocket()
-	s.stop = make(chan struct{}, 1)
 
-	cert, err := tls.LoadX509KeyPair(s.CertPem, s.CertKey)
+	material, err := s.loadTLSMaterial()
 	if err != nil {
-		return errs.WithE(err, "Failed to load server key")
-	}
-
-	certpool := x509.NewCertPool()
-	pem, err := ioutil.ReadFile(s.CAPem)
-	if err != nil {
-		return errs.WithE(err, "Failed to read client CA certificate authority")
-	}
-	if !certpool.AppendCertsFromPEM(pem) {
-		return errs.WithE(err, "failed to parse client CA certificate authority")
+		return err
 	}
+	s.material.Store(material)
 
-	config := tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    certpool,
-		Rand:         rand.Reader,
+	if s.ReloadInterval > 0 {
+		go s.watchFiles(s.ReloadInterval)
 	}
 
-	listener, err := tls.Listen("unix", s.SocketPath, &config)
+	listener, err := tls.Listen("unix", s.SocketPath, s.tlsConfig())
 	if err != nil {
 		return errs.WithEF(err, data.WithField("path", s.SocketPath), "Failed to listen on socket")
 	}
+	defer s.cleanupSocket()
 	if err := os.Chmod(s.SocketPath, os.ModeSocket|0700); err != nil {
+		_ = listener.Close()
 		return errs.WithEF(err, data.WithField("socket", s.SocketPath), "Failed to set socket permissions")
 	}
 
+	// Stop may have run before the listener was stored, it would never be closed
+	s.lock.Lock()
 	s.listener = listener
-	defer s.cleanupSocket()
+	select {
+	case <-s.stop:
+		_ = listener.Close()
+		s.lock.Unlock()
+		return nil
+	default:
+	}
+	s.lock.Unlock()
+	defer s.connections.Wait()
 
+	slots := make(chan struct{}, s.MaxConnections)
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-s.stop:
@@ -118,19 +393,63 @@ func (s *Server) Start() error {
 
 		socketStat, err := os.Stat(s.SocketPath)
 		if err != nil {
+			conn.Close()
 			return errs.WithEF(err, data.WithField("socket", s.SocketPath), "Failed to get socket stats")
 		}
 		if socketStat.Mode() != os.ModeSocket|0700 {
+			conn.Close()
 			return errs.WithF(data.WithField("socket", s.SocketPath).WithField("mode", socketStat.Mode()).WithField("xx", os.FileMode(0700)), "Socket mod changed")
 		}
 
-		//go s.handleConnection(conn)
-		s.handleConnection(conn) // we don't need a high throughput server
+		// taken once accepted, a slot held while accepting would be missed by waiters taking theirs back
+		slot := &workerSlot{pool: slots}
+		if !slot.acquire(s.stop) {
+			conn.Close()
+			return nil
+		}
+		s.connections.Add(1)
+		go func() {
+			defer s.connections.Done()
+			defer slot.release()
+			s.handleConnection(conn, slot)
+		}()
+	}
+}
+
+// workerSlot is the place of a connection in the pool of MaxConnections, used by a single goroutine
+type workerSlot struct {
+	pool chan struct{}
+	held bool
+}
+
+func (w *workerSlot) release() {
+	if w != nil && w.held {
+		<-w.pool
+		w.held = false
+	}
+}
+
+// acquire blocks until a place is free, false if stop is closed first
+func (w *workerSlot) acquire(stop <-chan struct{}) bool {
+	if w == nil || w.held {
+		return true
+	}
+	select {
+	case w.pool <- struct{}{}:
+		w.held = true
+		return true
+	case <-stop:
+		return false
 	}
 }
 
 func (s *Server) Stop(e error) {
-	s.stop <- struct{}{}
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if s.listener != nil {
 		_ = s.listener.Close()
 	}
@@ -149,8 +468,8 @@ func (s *Server) cleanupSocket() {
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
-	err := s.handleConnectionE(conn)
+func (s *Server) handleConnection(conn net.Conn, slot *workerSlot) {
+	err := s.handleConnectionE(conn, slot)
 	if err != nil {
 		logs.WithE(err).Error("Client connection handle failed")
 	}
@@ -160,7 +479,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 }
 
-func (s *Server) handleConnectionE(conn net.Conn) error {
+func (s *Server) handleConnectionE(conn net.Conn, slot *workerSlot) error {
 	defer conn.Close()
 
 	tlscon, ok := conn.(*tls.Conn)
@@ -168,8 +487,77 @@ func (s *Server) handleConnectionE(conn net.Conn) error {
 		return errs.With("Connection is not tls")
 	}
 
-	err := tlscon.Handshake()
+	// covers the handshake, so a client cannot hold a slot without talking
+	if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		return errs.WithE(err, "Failed to set deadline on socket connection")
+	}
+
+	client := &clientInfo{}
+	if err := s.identifyClient(tlscon, client); err != nil {
+		record := client.auditRecord(AuditConnect)
+		record.Outcome = AuditRefused
+		record.Message = auditMessage(err)
+		if err := s.Audit.Record(record); err != nil {
+			logs.WithE(err).Error("Failed to write audit record")
+		}
+		return err
+	}
+	record := client.auditRecord(AuditConnect)
+	record.Outcome = StatusOK.String()
+	if err := s.Audit.Record(record); err != nil {
+		return errs.WithE(err, "Failed to write audit record")
+	}
+
+	codec, err := negotiate(conn, s.commandNames())
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return errs.WithE(err, "Protocol negotiation failed")
+	}
+
+	for {
+		if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+			return errs.WithE(err, "Failed to set deadline on socket connection")
+		}
+
+		req, err := codec.ReadRequest()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errs.WithE(err, "Failed to read command on socket")
+		}
+
+		req.conn = conn
+		req.slot = slot
+		resp := s.handleRequest(req, client)
+		if err := codec.WriteResponse(resp); err != nil {
+			return errs.WithEF(err, data.WithField("command", req.Command), "Failed to write response")
+		}
+
+		if resp.err != nil {
+			// a missing secret is an expected answer, the connection can go on
+			if resp.Status == StatusNotSet && codec.Version() != ProtocolText {
+				logs.WithEF(resp.err, data.WithField("command", req.Command)).Warn("Client command failed")
+				continue
+			}
+			return errs.WithEF(resp.err, data.WithField("command", req.Command), "Client command failed")
+		}
+	}
+}
+
+// identifyClient fills client with the peer credentials, then with the certificate of the TLS handshake
+func (s *Server) identifyClient(tlscon *tls.Conn, client *clientInfo) error {
+	creds, err := getConnectionCredentials(tlscon)
 	if err != nil {
+		return errs.WithE(err, "Failed to read client credentials")
+	}
+	if creds != nil {
+		client.Peer = newPeerInfo(creds)
+	}
+
+	if err := tlscon.Handshake(); err != nil {
 		return errs.WithE(err, "TLS handshare failed")
 	}
 
@@ -181,56 +569,219 @@ func (s *Server) handleConnectionE(conn net.Conn) error {
 		}
 		logs.WithF(data.WithField("key", key)).Debug("Client public key")
 	}
+	if len(state.PeerCertificates) > 0 {
+		client.Certificate = state.PeerCertificates[0]
+		if s.material.Load().revocations.Revoked(client.Certificate) {
+			return errs.WithF(data.WithField("serial", serialKey(client.Certificate.SerialNumber)).
+				WithField("cn", client.Certificate.Subject.CommonName), "Client certificate is revoked")
+		}
+	}
+	return nil
+}
+
+// handleRequest records the request in the audit log, runs it only once recorded, then records its outcome.
+// A response whose outcome is not recorded is not sent.
+func (s *Server) handleRequest(req *request, client *clientInfo) *response {
+	attempt := client.auditRecord(AuditRequest)
+	attempt.Command = req.Command
+	if secretCommands[req.Command] {
+		attempt.Name = req.name()
+	}
+	if err := s.Audit.Record(attempt); err != nil {
+		req.destroy()
+		return errorResponse(errs.WithE(err, "Failed to write audit record, command refused"))
+	}
+
+	resp := s.runRequest(req, client)
 
-	creds, err := getConnectionCredentials(conn)
+	record := attempt
+	record.Time = time.Time{}
+	record.Event = AuditCommand
+	record.Outcome = resp.Status.String()
+	if resp.err != nil {
+		record.Message = auditMessage(resp.err)
+	}
+	if err := s.Audit.Record(record); err != nil {
+		if resp.Payload != nil {
+			resp.Payload.Destroy()
+		}
+		return errorResponse(errs.WithE(err, "Failed to write audit record"))
+	}
+	return resp
+}
+
+func (s *Server) runRequest(req *request, client *clientInfo) *response {
+	defer req.destroy()
+
+	if err := s.authorize(req, client); err != nil {
+		return errorResponse(errs.WithEF(err, client.fields().WithField("command", req.Command), "Unauthorized access"))
+	}
+
+	commandFunc, ok := s.commands[req.Command]
+	if !ok {
+		return errorResponse(newStatusError(StatusUnknownCommand, "Unknown command "+req.Command))
+	}
+
+	req.client = client
+	resp, err := commandFunc(req)
 	if err != nil {
-		return errs.WithE(err, "Failed to read client credentials")
+		return errorResponse(err)
 	}
+	return resp
+}
 
-	if creds != nil && creds.Uid != s.userUid {
-		return errs.WithEF(err, data.WithField("uid", creds.Uid), "Unauthorized access")
+func (s *Server) authorize(req *request, client *clientInfo) error {
+	if client == nil {
+		client = &clientInfo{}
+	}
+	if client.Peer != nil && client.Peer.Uid != s.userUid {
+		return newStatusError(StatusUnauthorized, "Peer user is not allowed")
+	}
+	if err := s.Policy.authorizePeer(req.Command, client.Peer); err != nil {
+		return err
 	}
 
-	for {
-		if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
-			return errs.WithE(err, "Failed to set deadline on socket connection")
-		}
+	secret := ""
+	if secretCommands[req.Command] {
+		secret = req.name()
+	}
+	return s.Policy.authorizeCertificate(req.Command, secret, client.Certificate)
+}
 
-		command, err := readCommand(conn)
-		if err != nil {
-			if err == io.EOF {
-				return nil
+// waitSecret blocks until the secret of the request is set, replies NOT_SET when timeout elapses first.
+// It subscribes to the store, so a name never set does not stay in it. While blocked, the connection
+// gives its worker slot back for a place in the waiters pool, so the client setting the secret can connect.
+func (s *Server) waitSecret(req *request, store *Store, timeout time.Duration) (*response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	isSet := func() bool {
+		service, ok := store.Lookup(req.name())
+		return ok && service.IsSet()
+	}
+
+	// subscribe before checking, to not miss a set in between
+	sub := store.Subscribe(ctx, 16)
+	if isSet() {
+		return &response{}, nil
+	}
+
+	if err := req.extendDeadline(timeout + s.Timeout); err != nil {
+		return nil, errs.WithE(err, "Failed to extend deadline on socket connection")
+	}
+	select {
+	case s.waiters <- struct{}{}:
+	default:
+		return nil, newStatusError(StatusInternal, "Too many clients waiting for a secret")
+	}
+	req.slot.release()
+
+	gone, unwatch := req.watchPeer()
+	resp, err := s.awaitSecret(sub, isSet, gone)
+	unwatchErr := unwatch()
+	<-s.waiters
+	if unwatchErr != nil {
+		// the connection is closed, no need for a slot
+		return nil, unwatchErr
+	}
+	if !req.slot.acquire(s.stop) {
+		return nil, errs.With("Server is stopping")
+	}
+	return resp, err
+}
+
+// awaitSecret checks isSet on each event of sub, until it ends or the client is gone
+func (s *Server) awaitSecret(sub *Subscription, isSet func() bool, gone <-chan struct{}) (*response, error) {
+	for {
+		select {
+		case _, ok := <-sub.Events():
+			if !ok {
+				return nil, newStatusError(StatusNotSet, "Timed out waiting for secret")
 			}
-			return errs.WithE(err, "Failed to read command on socket")
+			// checked on any event, the set event can be dropped only when others are pending
+			if isSet() {
+				return &response{}, nil
+			}
+		case <-gone:
+			return nil, errs.With("Client stopped waiting")
+		case <-s.stop:
+			return nil, errs.With("Server is stopping")
 		}
+	}
+}
+
+// ttlOption reads the ttl option, DefaultTTL when not given, capped to MaxTTL
+func (s *Server) ttlOption(options map[string]string) (time.Duration, error) {
+	ttl, err := durationOption(options, "ttl", s.DefaultTTL)
+	if err != nil {
+		return 0, err
+	}
+	if s.MaxTTL > 0 && (ttl == 0 || ttl > s.MaxTTL) {
+		ttl = s.MaxTTL
+	}
+	return ttl, nil
+}
 
-		commandFunc, ok := s.commands[command]
+// durationOption reads a duration option, fallback when not given
+func durationOption(options map[string]string, key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := options[key]
+	if !ok {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, newStatusError(StatusInvalidArgument, "Invalid "+key+" option "+value)
+	}
+	return duration, nil
+}
+
+// parseOptions reads the key=value arguments following the secret name
+func parseOptions(args []string) (map[string]string, error) {
+	options := make(map[string]string)
+	if len(args) < 2 {
+		return options, nil
+	}
+	for _, arg := range args[1:] {
+		key, value, ok := strings.Cut(arg, "=")
 		if !ok {
-			return errs.WithEF(err, data.WithField("command", command), "Unknown command on socket")
+			return nil, newStatusError(StatusInvalidArgument, "Invalid option "+arg)
 		}
+		options[key] = value
+	}
+	return options, nil
+}
 
-		if err := commandFunc(conn); err != nil {
-			return errs.WithE(err, "Client command failed")
-		}
+func (s *Server) commandNames() []string {
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
 func readCommand(conn net.Conn) (string, error) {
-	command := ""
+	command, _, err := readWord(conn)
+	return command, err
+}
+
+// readWord reads until a space or a new line and returns the delimiter found
+func readWord(conn io.Reader) (string, byte, error) {
+	word := ""
 	buffer := make([]byte, 1)
 	for {
 		n, err := conn.Read(buffer)
 		if err != nil {
-			return "", err
+			return "", 0, err
 		}
 		if n == 0 {
-			return "", err
+			return "", 0, err
 		}
 
-		if string(buffer) == " " || string(buffer) == "\n" {
-			return command, nil
+		if buffer[0] == ' ' || buffer[0] == '\n' {
+			return word, buffer[0], nil
 		}
-		command += string(buffer)
+		word += string(buffer)
 	}
 }
 
@@ -245,23 +796,3 @@ func WriteBytes(conn io.Writer, bytes []byte) error {
 	}
 	return nil
 }
-
-func unixConnFromTLSConn(conn tls.Conn) (*net.UnixConn, error) {
-	value := reflect.ValueOf(conn)
-	field := value.FieldByName("conn")
-
-	// Fails with "reflect.Value.UnsafeAddr of unaddressable value" because rs isn't addressable:
-	// field = reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
-
-	valueCopy := reflect.New(value.Type()).Elem()
-	valueCopy.Set(value)
-	field = valueCopy.FieldByName("conn")
-	field = reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
-
-	i := field.Interface()
-	uc, ok := i.(*net.UnixConn)
-	if !ok {
-		return nil, errs.With("Failed to get unix connection from tls connection")
-	}
-	return uc, nil
-}
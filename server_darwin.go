@@ -10,3 +10,8 @@ func getConnectionCredentials(c net.Conn) (*unix.Ucred, error) {
 	// darwin does not support SO_PEERCRED
 	return nil, nil
 }
+
+func newPeerInfo(creds *unix.Ucred) *PeerInfo {
+	// darwin has no peer credentials nor /proc
+	return nil
+}
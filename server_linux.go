@@ -3,6 +3,9 @@ package memguarded
 import (
 	"crypto/tls"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/n0rad/go-erlog/errs"
 	"golang.org/x/sys/unix"
@@ -15,9 +18,9 @@ func getConnectionCredentials(c net.Conn) (*unix.Ucred, error) {
 	if !ok {
 		return cred, errs.With("Connection is not tls")
 	}
-	uc, err := unixConnFromTLSConn(*tlscon)
-	if err != nil {
-		return nil, err
+	uc, ok := tlscon.NetConn().(*net.UnixConn)
+	if !ok {
+		return nil, errs.With("Failed to get unix connection from tls connection")
 	}
 
 	raw, err := uc.SyscallConn()
@@ -41,3 +44,44 @@ func getConnectionCredentials(c net.Conn) (*unix.Ucred, error) {
 
 	return cred, nil
 }
+
+func newPeerInfo(creds *unix.Ucred) *PeerInfo {
+	peer := &PeerInfo{
+		Uid: creds.Uid,
+		Gid: creds.Gid,
+		Pid: creds.Pid,
+	}
+	readPeerProcess(peer)
+	return peer
+}
+
+// readPeerProcess completes peer with what /proc knows about its pid, missing entries are left empty
+func readPeerProcess(peer *PeerInfo) {
+	proc := "/proc/" + strconv.Itoa(int(peer.Pid))
+
+	if exe, err := os.Readlink(proc + "/exe"); err == nil {
+		peer.Exe = exe
+	}
+
+	if status, err := os.ReadFile(proc + "/status"); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			if !strings.HasPrefix(line, "Groups:") {
+				continue
+			}
+			for _, group := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+				if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+					peer.Groups = append(peer.Groups, uint32(gid))
+				}
+			}
+		}
+	}
+
+	if cgroups, err := os.ReadFile(proc + "/cgroup"); err == nil {
+		for _, line := range strings.Split(strings.TrimSpace(string(cgroups)), "\n") {
+			// hierarchy-ID:controllers:path
+			if parts := strings.SplitN(line, ":", 3); len(parts) == 3 {
+				peer.Cgroups = append(peer.Cgroups, parts[2])
+			}
+		}
+	}
+}
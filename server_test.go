@@ -2,9 +2,13 @@ package memguarded
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -131,7 +135,7 @@ func TestHandleConnection_DoesNotPanicOnError(t *testing.T) {
 	// handleConnection wraps the error and does not panic.
 	conn := &fakeConn{Reader: &bytes.Buffer{}, Writer: &bytes.Buffer{}}
 
-	fs.handleConnection(conn)
+	fs.handleConnection(conn, nil)
 	// No assertion needed other than "did not panic".
 }
 
@@ -147,4 +151,354 @@ func TestServer_InitRegistersCommands(t *testing.T) {
 	// Expect the commands map to contain the known commands.
 	assert.Contains(t, s.commands, "set_secret")
 	assert.Contains(t, s.commands, "get_secret")
+	assert.Contains(t, s.commands, "list_secrets")
+	assert.Contains(t, s.commands, "clear_secret")
+	assert.Contains(t, s.commands, "delete_secret")
+}
+
+func TestServer_InitServesSingleSecret(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	svc := NewService()
+	var s Server
+	assert.NoError(t, s.Init(svc))
+
+	resp := s.handleRequest(&request{Command: "set_secret", Payload: memguard.NewBufferFromBytes([]byte("s3cr3t"))}, nil)
+	assert.Equal(t, StatusOK, resp.Status)
+	assert.Equal(t, "s3cr3t", getTestSecret(t, svc))
+}
+
+func TestServer_NamedSecrets(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	store := NewStore()
+	var s Server
+	assert.NoError(t, s.InitStore(store))
+
+	_, err := s.commands["set_secret"](&request{Args: []string{"db"}, Payload: memguard.NewBufferFromBytes([]byte("s3cr3t"))})
+	assert.NoError(t, err)
+
+	resp, err := s.commands["get_secret"](&request{Args: []string{"db"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("s3cr3t"), resp.Payload.Bytes())
+	resp.Payload.Destroy()
+
+	resp, err = s.commands["list_secrets"](&request{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db"}, resp.Values)
+
+	_, err = s.commands["delete_secret"](&request{Args: []string{"db"}})
+	assert.NoError(t, err)
+	assert.Empty(t, store.Names())
+}
+
+func TestServer_SetSecretRefusesEmptyPayload(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	store := NewStore()
+	var s Server
+	assert.NoError(t, s.InitStore(store))
+
+	for _, command := range []string{"set_secret", "rotate_secret"} {
+		resp := s.handleRequest(&request{Command: command, Args: []string{"db"}}, nil)
+		assert.Equal(t, StatusInvalidArgument, resp.Status, command)
+		resp = s.handleRequest(&request{Command: command, Args: []string{"db"}, Payload: memguard.NewBuffer(0)}, nil)
+		assert.Equal(t, StatusInvalidArgument, resp.Status, command)
+	}
+	_, ok := store.Lookup("db")
+	assert.False(t, ok, "no version nor event for an empty secret")
+}
+
+func TestServer_HandleRequestStatus(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	var s Server
+	assert.NoError(t, s.InitStore(NewStore()))
+
+	resp := s.handleRequest(&request{Command: "get_secret"}, nil)
+	assert.Equal(t, StatusNotSet, resp.Status)
+
+	resp = s.handleRequest(&request{Command: "nope"}, nil)
+	assert.Equal(t, StatusUnknownCommand, resp.Status)
+
+	resp = s.handleRequest(&request{Command: "list_secrets"}, &clientInfo{Peer: &PeerInfo{Uid: s.userUid + 1}})
+	assert.Equal(t, StatusUnauthorized, resp.Status)
+
+	resp = s.handleRequest(&request{Command: "list_secrets"}, nil)
+	assert.Equal(t, StatusOK, resp.Status)
+}
+
+func TestServer_ConcurrentClients(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	store := NewStore()
+	server := startTestServer(t, pki, store)
+
+	// a client holding its connection must not block the others
+	newTestClient(t, pki, server)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := &Client{SocketPath: server.SocketPath, CertPem: pki.ClientPem, CertKey: pki.ClientKey, CAPem: pki.CAPem, CertPassphrase: NewService()}
+			if err := client.Connect(); err != nil {
+				errs <- err
+				return
+			}
+			defer client.Close()
+
+			name := "secret" + strconv.Itoa(i%4)
+			value := NewService()
+			b := []byte("value-" + name)
+			_ = value.FromBytes(&b)
+			if err := client.SetNamedSecret(name, value); err != nil {
+				errs <- err
+				return
+			}
+
+			got := NewService()
+			if err := client.GetNamedSecret(name, got); err != nil {
+				errs <- err
+				return
+			}
+			buffer, err := got.Get()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer buffer.Destroy()
+			if string(buffer.Bytes()) != "value-"+name {
+				errs <- errors.New("unexpected secret " + string(buffer.Bytes()))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"secret0", "secret1", "secret2", "secret3"}, store.Names())
+}
+
+func TestServer_StopIsIdempotent(t *testing.T) {
+	var s Server
+	assert.NoError(t, s.InitStore(NewStore()))
+
+	s.Stop(nil)
+	s.Stop(nil)
+}
+
+func TestServer_SetSecretTTLOptions(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	store := NewStore()
+	s := Server{DefaultTTL: time.Minute, MaxTTL: time.Hour}
+	assert.NoError(t, s.InitStore(store))
+
+	resp := s.handleRequest(&request{Command: "set_secret", Args: []string{"a"}, Payload: memguard.NewBufferFromBytes([]byte("x"))}, nil)
+	assert.Equal(t, StatusOK, resp.Status)
+	assert.Equal(t, time.Minute, store.Service("a").TTL())
+	assert.Equal(t, time.Duration(0), store.Service("a").IdleTTL(), "no idle expiry when not asked")
+
+	resp = s.handleRequest(&request{Command: "set_secret", Args: []string{"a", "idle-ttl=0"}, Payload: memguard.NewBufferFromBytes([]byte("x"))}, nil)
+	assert.Equal(t, StatusOK, resp.Status)
+	assert.Equal(t, time.Duration(0), store.Service("a").IdleTTL())
+
+	resp = s.handleRequest(&request{Command: "set_secret", Args: []string{"a", "ttl=48h", "idle-ttl=5m"}, Payload: memguard.NewBufferFromBytes([]byte("x"))}, nil)
+	assert.Equal(t, StatusOK, resp.Status)
+	assert.Equal(t, time.Hour, store.Service("a").TTL())
+	assert.Equal(t, 5*time.Minute, store.Service("a").IdleTTL())
+
+	resp = s.handleRequest(&request{Command: "set_secret", Args: []string{"a", "ttl=soon"}, Payload: memguard.NewBufferFromBytes([]byte("x"))}, nil)
+	assert.Equal(t, StatusInvalidArgument, resp.Status)
+}
+
+func TestServer_ClearSecretOverSocket(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	store := NewStore()
+	client := newTestClient(t, pki, startTestServer(t, pki, store))
+
+	b := []byte("locked-on-leave")
+	assert.NoError(t, store.Service(DefaultSecretName).FromBytes(&b))
+
+	assert.NoError(t, client.ClearSecret())
+	assert.False(t, store.Service(DefaultSecretName).IsSet())
+	assert.True(t, errors.Is(client.GetSecret(NewService()), ErrSecretNotSet))
+}
+
+func TestServer_WaitSecret(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	store := NewStore()
+	server := startTestServer(t, pki, store)
+	waiter := newTestClient(t, pki, server)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		b := []byte("unlocked")
+		_ = store.Service("boot").FromBytes(&b)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, waiter.WaitNamedSecret(ctx, "boot"))
+
+	got := NewService()
+	assert.NoError(t, waiter.GetNamedSecret("boot", got))
+	assert.True(t, got.IsSet())
+}
+
+func TestServer_WaitSecretTimeout(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	store := NewStore()
+	waiter := newTestClient(t, pki, startTestServer(t, pki, store))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := waiter.WaitNamedSecret(ctx, "typo")
+	assert.True(t, errors.Is(err, ErrSecretNotSet))
+	_, ok := store.Lookup("typo")
+	assert.False(t, ok, "waiting does not create the secret")
+
+	// connection is still usable after a timeout
+	_, err = waiter.ListSecrets()
+	assert.NoError(t, err)
+}
+
+func TestServer_WaitersDoNotHoldWorkerSlots(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	store := NewStore()
+	server := runTestServer(t, &Server{
+		SocketPath:     filepath.Join(pki.Dir, "waiters.sock"),
+		CertPem:        pki.ServerPem,
+		CertKey:        pki.ServerKey,
+		CAPem:          pki.CAPem,
+		MaxConnections: 2,
+	}, store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results := make(chan error, server.MaxConnections)
+	waiters := []*Client{}
+	for i := 0; i < server.MaxConnections; i++ {
+		waiter := newTestClient(t, pki, server)
+		waiters = append(waiters, waiter)
+		go func() { results <- waiter.WaitNamedSecret(ctx, "boot") }()
+	}
+	waitForWaiters(t, server, server.MaxConnections)
+
+	set := make(chan error, 1)
+	go func() {
+		setter := testClient(pki, server)
+		if err := setter.Connect(); err != nil {
+			set <- err
+			return
+		}
+		defer setter.Close()
+		secret := NewService()
+		setTestSecret(t, secret, "unlocked")
+		set <- setter.SetNamedSecret("boot", secret)
+	}()
+	select {
+	case err := <-set:
+		assert.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("set is blocked by the waiters")
+	}
+	for range waiters {
+		assert.NoError(t, <-results)
+	}
+	for _, waiter := range waiters {
+		waiter.Close()
+	}
+
+	// a waiter going away is dropped
+	gone, stop := context.WithCancel(context.Background())
+	waiter := newTestClient(t, pki, server)
+	go func() { results <- waiter.WaitNamedSecret(gone, "later") }()
+	waitForWaiters(t, server, 1)
+	stop()
+	assert.Error(t, <-results)
+	waitForWaiters(t, server, 0)
+}
+
+func waitForWaiters(t *testing.T, server *Server, count int) {
+	for deadline := time.Now().Add(5 * time.Second); len(server.waiters) != count; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d waiters, expected %d", len(server.waiters), count)
+		}
+	}
+}
+
+func TestServer_PolicyDenialIsReturned(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	server := &Server{
+		SocketPath: filepath.Join(pki.Dir, "test.sock"),
+		CertPem:    pki.ServerPem,
+		CertKey:    pki.ServerKey,
+		CAPem:      pki.CAPem,
+		Policy:     &Policy{Peers: []PeerRule{{Commands: []string{"list_secrets"}, Exes: []string{"/nowhere"}}}},
+	}
+	client := newTestClient(t, pki, runTestServer(t, server, NewStore()))
+
+	_, err := client.ListSecrets()
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+}
+
+func TestServer_CertificateRules(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	pki := newTestPKI(t)
+	server := &Server{
+		SocketPath: filepath.Join(pki.Dir, "test.sock"),
+		CertPem:    pki.ServerPem,
+		CertKey:    pki.ServerKey,
+		CAPem:      pki.CAPem,
+		Policy:     &Policy{Certificates: []CertificateRule{{CommonNames: []string{"client"}, Commands: []string{"get_secret"}}}},
+	}
+	store := NewStore()
+	client := newTestClient(t, pki, runTestServer(t, server, store))
+
+	b := []byte("value")
+	assert.NoError(t, store.Service(DefaultSecretName).FromBytes(&b))
+	assert.NoError(t, client.GetSecret(NewService()))
+	assert.True(t, errors.Is(client.ClearSecret(), ErrUnauthorized))
+	assert.True(t, store.Service(DefaultSecretName).IsSet())
+}
+
+func TestServer_StopBeforeListening(t *testing.T) {
+	pki := newTestPKI(t)
+	server := &Server{
+		SocketPath: filepath.Join(pki.Dir, "stopped.sock"),
+		CertPem:    pki.ServerPem,
+		CertKey:    pki.ServerKey,
+		CAPem:      pki.CAPem,
+	}
+	if err := server.InitStore(NewStore()); err != nil {
+		t.Fatal(err)
+	}
+	server.Stop(nil)
+
+	done := make(chan error, 1)
+	go func() { done <- server.Start() }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
 }
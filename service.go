@@ -1,24 +1,40 @@
 package memguarded
 
 import (
-	"fmt"
 	"io"
-	"net"
-	"os"
 	"sync"
-	"syscall"
+	"time"
 
 	"github.com/awnumar/memguard"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/n0rad/go-erlog/logs"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
 type Service struct {
 	secret     *memguard.Enclave
-	notify     map[chan struct{}]struct{}
-	notifyLock sync.RWMutex
-	stop       chan struct{}
+	secretLock sync.RWMutex
+	generation uint64
+	setAt      time.Time
+	lastAccess time.Time
+	gets       uint64
+	ttl        time.Duration
+	idleTTL    time.Duration
+	expire     *time.Timer
+	version    uint64
+	setter     string
+	// history holds the previous versions, oldest first
+	history     []*secretVersion
+	historySize int
+	name        string
+	notify      map[chan struct{}]struct{}
+	// subscriptions is created on first subscribe, so a zero Service can be subscribed
+	subscriptions map[*Subscription]struct{}
+	notifyLock    sync.RWMutex
+	// onChange forwards the events to the store holding the service
+	onChange func(Event)
+	stop     chan struct{}
+
+	Prompter Prompter // asks the secret in AskSecret, the terminal if nil
 }
 
 func NewService() *Service {
@@ -27,6 +43,18 @@ func NewService() *Service {
 	return s
 }
 
+// NewNamedService returns a service whose events carry name
+func NewNamedService(name string) *Service {
+	s := NewService()
+	s.name = name
+	return s
+}
+
+// Name is the secret name carried by events, empty if not named
+func (s *Service) Name() string {
+	return s.name
+}
+
 func (s *Service) Init() {
 	s.notify = make(map[chan struct{}]struct{})
 	s.stop = make(chan struct{})
@@ -48,7 +76,7 @@ func (s *Service) FromBytes(secret *[]byte) error {
 	return nil
 }
 
-func (s *Service) FromReaderUntilNewLine(conn net.Conn) error {
+func (s *Service) FromReaderUntilNewLine(conn io.Reader) error {
 	buffer, err := memguard.NewBufferFromReaderUntil(conn, '\n')
 	if err != nil && err != io.EOF {
 		return errs.WithE(err, "Failed to read secret from connection")
@@ -57,48 +85,32 @@ func (s *Service) FromReaderUntilNewLine(conn net.Conn) error {
 	return nil
 }
 
+// AskSecret asks the secret with the service Prompter, on the terminal if not set
 func (s *Service) AskSecret(confirmation bool, name string) error {
-	if !terminal.IsTerminal(int(os.Stdout.Fd())) {
-		return errs.With("Cannot ask secret, not in a terminal")
+	return s.AskSecretWithOptions(name, AskOptions{Confirmation: confirmation})
+}
+
+// AskSecretWithOptions asks the secret with the service Prompter until options accept it
+func (s *Service) AskSecretWithOptions(name string, options AskOptions) error {
+	prompter := s.Prompter
+	if prompter == nil {
+		prompter = TerminalPrompter{}
 	}
-	return s.FromStdin(confirmation, name)
+	return s.ask(prompter, name, options)
 }
 
+// FromStdin asks the secret on the terminal, even if stdout is not one
 func (s *Service) FromStdin(confirmation bool, name string) error {
-	var secret, secretConfirm []byte
-	defer memguard.WipeBytes(secret)
-	defer memguard.WipeBytes(secretConfirm)
-
-	for {
-		var err error
-
-		print(name + ": ")
-		secret, err = terminal.ReadPassword(syscall.Stdin)
-		if err != nil {
-			return errs.WithE(err, "Cannot read secret")
-		}
-
-		print("\n")
-		if !confirmation {
-			s.setAndNotify(memguard.NewBufferFromBytes(secret))
-			return nil
-		}
+	return s.ask(stdinPrompter{}, name, AskOptions{Confirmation: confirmation})
+}
 
-		print("Confirm: ")
-		secretConfirm, err = terminal.ReadPassword(syscall.Stdin)
-		if err != nil {
-			return errs.WithE(err, "Cannot read secret")
-		}
-		print("\n")
-
-		if string(secret) == string(secretConfirm) && string(secret) != "" {
-			s.setAndNotify(memguard.NewBufferFromBytes(secret))
-			return nil
-		} else {
-			fmt.Println("\nEmpty secret or do not match...")
-			fmt.Println()
-		}
+func (s *Service) ask(prompter Prompter, name string, options AskOptions) error {
+	buffer, err := options.ask(prompter, name)
+	if err != nil {
+		return err
 	}
+	s.setAndNotify(buffer)
+	return nil
 }
 
 func (s *Service) Unwatch(c chan struct{}) {
@@ -108,24 +120,27 @@ func (s *Service) Unwatch(c chan struct{}) {
 	delete(s.notify, c)
 }
 
+// Watch returns a channel signaled on any change, pending signals are merged.
+// Use Subscribe to know the kind of change.
 func (s *Service) Watch() chan struct{} {
 	s.notifyLock.Lock()
 	defer s.notifyLock.Unlock()
 
-	c := make(chan struct{})
+	c := make(chan struct{}, 1)
 	s.notify[c] = struct{}{}
 	return c
 }
 
-func (s Service) Write(writer io.Writer) error {
+func (s *Service) Write(writer io.Writer) error {
 	var total, written int
 	var err error
 
-	if s.secret == nil {
-		return errs.With("Secret is not set")
+	enclave := s.access()
+	if enclave == nil {
+		return newStatusError(StatusNotSet, "Secret is not set")
 	}
 
-	lockedBuffer, err := s.secret.Open()
+	lockedBuffer, err := enclave.Open()
 	if err != nil {
 		return errs.WithE(err, "Failed to open secret enclave")
 	}
@@ -142,11 +157,12 @@ func (s Service) Write(writer io.Writer) error {
 	return nil
 }
 
-func (s Service) Reader() io.Reader {
-	if s.secret == nil {
+func (s *Service) Reader() io.Reader {
+	enclave := s.access()
+	if enclave == nil {
 		return nil
 	}
-	return &secretReader{enclave: s.secret}
+	return &secretReader{enclave: enclave}
 }
 
 type secretReader struct {
@@ -189,29 +205,194 @@ func (r *secretReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
-func (s Service) IsSet() bool {
-	if s.secret != nil {
-		return true
+func (s *Service) IsSet() bool {
+	return s.enclave() != nil
+}
+
+func (s *Service) Get() (*memguard.LockedBuffer, error) {
+	enclave := s.access()
+	if enclave == nil {
+		return nil, newStatusError(StatusNotSet, "No secret set")
 	}
-	return false
+	return enclave.Open()
+}
+
+// Clear destroys the secret and the previous versions still readable, and notifies watchers
+func (s *Service) Clear() {
+	s.secretLock.Lock()
+	s.secret = nil
+	s.forgetValues()
+	s.generation++
+	s.scheduleExpiration()
+	s.secretLock.Unlock()
+
+	logs.Debug("Secret cleared")
+	s.notifyAll(EventCleared)
+}
+
+// SetTTL destroys the secret ttl after it was set, 0 keeps it until replaced
+func (s *Service) SetTTL(ttl time.Duration) {
+	s.secretLock.Lock()
+	defer s.secretLock.Unlock()
+
+	s.ttl = ttl
+	s.scheduleExpiration()
+}
+
+// SetIdleTTL destroys the secret when it was not read for idle, 0 keeps it until replaced
+func (s *Service) SetIdleTTL(idle time.Duration) {
+	s.secretLock.Lock()
+	defer s.secretLock.Unlock()
+
+	s.idleTTL = idle
+	s.scheduleExpiration()
+}
+
+func (s *Service) TTL() time.Duration {
+	s.secretLock.RLock()
+	defer s.secretLock.RUnlock()
+
+	return s.ttl
+}
+
+func (s *Service) IdleTTL() time.Duration {
+	s.secretLock.RLock()
+	defer s.secretLock.RUnlock()
+
+	return s.idleTTL
 }
 
-func (s Service) Get() (*memguard.LockedBuffer, error) {
-	if !s.IsSet() {
-		return nil, errs.With("No secret set")
+// ExpiresAt returns when the secret will be destroyed if not read or replaced before
+func (s *Service) ExpiresAt() (time.Time, bool) {
+	s.secretLock.RLock()
+	defer s.secretLock.RUnlock()
+
+	if s.secret == nil {
+		return time.Time{}, false
 	}
-	return s.secret.Open()
+	return s.expiresAt()
 }
 
 /////
 
+func (s *Service) enclave() *memguard.Enclave {
+	s.secretLock.RLock()
+	defer s.secretLock.RUnlock()
+
+	return s.secret
+}
+
+// access returns the enclave for a read, pushing back the idle expiration
+func (s *Service) access() *memguard.Enclave {
+	s.secretLock.Lock()
+	defer s.secretLock.Unlock()
+
+	s.lastAccess = time.Now()
+	s.gets++
+	return s.secret
+}
+
+func (s *Service) expiresAt() (time.Time, bool) {
+	var at time.Time
+	if s.ttl > 0 {
+		at = s.setAt.Add(s.ttl)
+	}
+	if s.idleTTL > 0 {
+		idle := s.lastAccess.Add(s.idleTTL)
+		if at.IsZero() || idle.Before(at) {
+			at = idle
+		}
+	}
+	return at, !at.IsZero()
+}
+
+// scheduleExpiration must be called with the secret lock held
+func (s *Service) scheduleExpiration() {
+	if s.expire != nil {
+		s.expire.Stop()
+		s.expire = nil
+	}
+	if s.secret == nil {
+		return
+	}
+	at, ok := s.expiresAt()
+	if !ok {
+		return
+	}
+
+	generation := s.generation
+	s.expire = time.AfterFunc(time.Until(at), func() {
+		s.expireIfDue(generation)
+	})
+}
+
+func (s *Service) expireIfDue(generation uint64) {
+	s.secretLock.Lock()
+	if generation != s.generation || s.secret == nil {
+		s.secretLock.Unlock()
+		return
+	}
+	if at, ok := s.expiresAt(); !ok || time.Now().Before(at) {
+		// read or ttl changed since the timer was set
+		s.scheduleExpiration()
+		s.secretLock.Unlock()
+		return
+	}
+
+	s.secret = nil
+	s.forgetValues()
+	s.generation++
+	s.expire = nil
+	s.secretLock.Unlock()
+
+	logs.Info("Secret expired")
+	s.notifyAll(EventExpired)
+}
+
+// state returns the secret with its expiration settings, without counting it as a read
+func (s *Service) state() (*memguard.Enclave, time.Time, time.Duration, time.Duration) {
+	s.secretLock.RLock()
+	defer s.secretLock.RUnlock()
+
+	return s.secret, s.setAt, s.ttl, s.idleTTL
+}
+
+// restore sets a secret saved at setAt, so its ttl keeps running from then
+func (s *Service) restore(buffer *memguard.LockedBuffer, setAt time.Time, ttl time.Duration, idleTTL time.Duration) {
+	s.secretLock.Lock()
+	s.secret = buffer.Seal()
+	s.version++
+	s.generation++
+	s.setAt = setAt
+	s.lastAccess = time.Now()
+	s.ttl = ttl
+	s.idleTTL = idleTTL
+	s.scheduleExpiration()
+	s.secretLock.Unlock()
+
+	s.notifyAll(EventSet)
+}
+
 func (s *Service) setAndNotify(buffer *memguard.LockedBuffer) {
+	s.replace(buffer, "", 0, EventSet)
+}
+
+// notifyAll never blocks, a watcher or a subscriber not reading cannot hold the service
+func (s *Service) notifyAll(kind EventKind) {
 	s.notifyLock.RLock()
 	defer s.notifyLock.RUnlock()
 
-	logs.Debug("Secret set")
-	s.secret = buffer.Seal()
+	event := Event{Kind: kind, Name: s.name, Time: time.Now()}
+	for sub := range s.subscriptions {
+		sub.deliver(event)
+	}
 	for e := range s.notify {
-		e <- struct{}{}
+		select {
+		case e <- struct{}{}:
+		default:
+		}
+	}
+	if s.onChange != nil {
+		s.onChange(event)
 	}
 }
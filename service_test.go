@@ -135,3 +135,83 @@ func TestService_WatchAndUnwatch(t *testing.T) {
 
 	svc.Unwatch(ch)
 }
+
+func TestService_TTLExpiresAndNotifies(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	svc := NewService()
+	svc.SetTTL(50 * time.Millisecond)
+	ch := svc.Watch()
+
+	b := []byte("short-lived")
+	go func() { _ = svc.FromBytes(&b) }()
+	<-ch
+	assert.True(t, svc.IsSet())
+
+	at, ok := svc.ExpiresAt()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(50*time.Millisecond), at, 50*time.Millisecond)
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("did not receive expiration notification")
+	}
+	assert.False(t, svc.IsSet())
+	svc.Unwatch(ch)
+}
+
+func TestService_IdleTTLPushedBackByReads(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	svc := NewService()
+	svc.SetIdleTTL(100 * time.Millisecond)
+	b := []byte("idle")
+	assert.NoError(t, svc.FromBytes(&b))
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		locked, err := svc.Get()
+		assert.NoError(t, err)
+		locked.Destroy()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, svc.IsSet())
+}
+
+func TestService_NewValueResetsTTL(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	svc := NewService()
+	svc.SetTTL(100 * time.Millisecond)
+	b := []byte("first")
+	assert.NoError(t, svc.FromBytes(&b))
+	time.Sleep(60 * time.Millisecond)
+	c := []byte("second")
+	assert.NoError(t, svc.FromBytes(&c))
+	time.Sleep(60 * time.Millisecond)
+
+	assert.True(t, svc.IsSet())
+}
+
+func TestService_ClearNotifies(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	svc := NewService()
+	b := []byte("to-clear")
+	assert.NoError(t, svc.FromBytes(&b))
+
+	ch := svc.Watch()
+	go svc.Clear()
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("did not receive clear notification")
+	}
+	assert.False(t, svc.IsSet())
+	_, err := svc.Get()
+	assert.Error(t, err)
+	svc.Unwatch(ch)
+}
@@ -0,0 +1,271 @@
+package memguarded
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// shamirCheckSize is the size of the sha256 prefix split with the secret, to detect wrong shares once combined
+const shamirCheckSize = 8
+
+// SplitSecret splits secret with Shamir's scheme over GF(256) in count shares, any threshold of them rebuilding it.
+// A share is the y of each byte followed by its x.
+func SplitSecret(secret []byte, count int, threshold int) ([]*memguard.LockedBuffer, error) {
+	if threshold < 2 || count < threshold || count > 255 {
+		return nil, errs.WithF(data.WithField("count", count).WithField("threshold", threshold),
+			"Shares need 2 <= threshold <= count <= 255")
+	}
+	if len(secret) == 0 {
+		return nil, errs.With("Cannot split an empty secret")
+	}
+
+	checked := memguard.NewBuffer(len(secret) + shamirCheckSize)
+	defer checked.Destroy()
+	checked.Copy(secret)
+	check := sha256.Sum256(secret)
+	checked.CopyAt(len(secret), check[:shamirCheckSize])
+
+	coefficients := memguard.NewBuffer(threshold)
+	defer coefficients.Destroy()
+
+	shares := make([]*memguard.LockedBuffer, count)
+	for i := range shares {
+		shares[i] = memguard.NewBuffer(checked.Size() + 1)
+		shares[i].Bytes()[checked.Size()] = byte(i + 1)
+	}
+	for b, value := range checked.Bytes() {
+		if _, err := rand.Read(coefficients.Bytes()[1:]); err != nil {
+			for _, share := range shares {
+				share.Destroy()
+			}
+			return nil, errs.WithE(err, "Failed to generate shares")
+		}
+		coefficients.Bytes()[0] = value
+		for i, share := range shares {
+			share.Bytes()[b] = gfEvaluate(coefficients.Bytes(), byte(i+1))
+		}
+	}
+	for _, share := range shares {
+		share.Freeze()
+	}
+	return shares, nil
+}
+
+// CombineShares rebuilds the secret of shares, failing if they do not come from the same split
+func CombineShares(shares [][]byte) (*memguard.LockedBuffer, error) {
+	if len(shares) < 2 {
+		return nil, errs.With("At least 2 shares are needed")
+	}
+	size := len(shares[0])
+	if size <= shamirCheckSize+1 {
+		return nil, errs.With("Share is too short")
+	}
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, errs.With("Shares have different sizes")
+		}
+		xs[i] = share[size-1]
+		if xs[i] == 0 {
+			// evaluated at 0 the share would be the secret, chosen by its holder whatever the others
+			return nil, errs.With("Share has no x")
+		}
+		for _, x := range xs[:i] {
+			if x == xs[i] {
+				return nil, errs.WithF(data.WithField("x", x), "Duplicate share")
+			}
+		}
+	}
+
+	combined := memguard.NewBuffer(size - 1)
+	defer combined.Destroy()
+	ys := make([]byte, len(shares))
+	for b := range combined.Bytes() {
+		for i, share := range shares {
+			ys[i] = share[b]
+		}
+		combined.Bytes()[b] = gfInterpolateZero(xs, ys)
+	}
+	memguard.WipeBytes(ys)
+
+	secretSize := combined.Size() - shamirCheckSize
+	check := sha256.Sum256(combined.Bytes()[:secretSize])
+	if subtle.ConstantTimeCompare(check[:shamirCheckSize], combined.Bytes()[secretSize:]) != 1 {
+		return nil, errs.With("Shares do not rebuild the secret")
+	}
+	secret := memguard.NewBuffer(secretSize)
+	secret.Copy(combined.Bytes()[:secretSize])
+	secret.Freeze()
+	return secret, nil
+}
+
+// Shares collects the shares submitted one at a time, each by a different holder,
+// and gives the secret to Unseal once Threshold shares are received
+type Shares struct {
+	Threshold int
+	Unseal    func(secret *memguard.LockedBuffer) error
+
+	shares  []*memguard.Enclave
+	holders map[string]bool
+	lock    sync.Mutex
+}
+
+// Submit adds the share of holder and returns the number of shares received, 0 once the secret is rebuilt.
+// Shares are forgotten when they fail to rebuild the secret, all holders must submit again.
+func (s *Shares) Submit(share *memguard.LockedBuffer, holder string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.holders == nil {
+		s.holders = make(map[string]bool)
+	}
+	if s.holders[holder] {
+		return len(s.shares), newStatusError(StatusInvalidArgument, "A share was already submitted with this certificate")
+	}
+	if share.Size() <= shamirCheckSize+1 || share.Bytes()[share.Size()-1] == 0 {
+		return len(s.shares), newStatusError(StatusInvalidArgument, "Invalid share")
+	}
+	copied := memguard.NewBuffer(share.Size())
+	copied.Copy(share.Bytes())
+	s.shares = append(s.shares, copied.Seal())
+	s.holders[holder] = true
+	logs.WithF(data.WithField("received", len(s.shares)).WithField("threshold", s.Threshold)).Info("Share received")
+	if len(s.shares) < s.Threshold {
+		return len(s.shares), nil
+	}
+
+	defer s.reset()
+	secret, err := s.combine()
+	if err != nil {
+		return 0, err
+	}
+	defer secret.Destroy()
+	if err := s.Unseal(secret); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// Progress returns the number of shares received and needed
+func (s *Shares) Progress() (int, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.shares), s.Threshold
+}
+
+func (s *Shares) combine() (*memguard.LockedBuffer, error) {
+	opened := make([]*memguard.LockedBuffer, 0, len(s.shares))
+	defer func() {
+		for _, share := range opened {
+			share.Destroy()
+		}
+	}()
+	shares := make([][]byte, 0, len(s.shares))
+	for _, enclave := range s.shares {
+		share, err := enclave.Open()
+		if err != nil {
+			return nil, errs.WithE(err, "Failed to open share")
+		}
+		opened = append(opened, share)
+		shares = append(shares, share.Bytes())
+	}
+
+	secret, err := CombineShares(shares)
+	if err != nil {
+		return nil, newStatusError(StatusInvalidArgument, err.Error())
+	}
+	return secret, nil
+}
+
+// reset must be called with the lock held
+func (s *Shares) reset() {
+	s.shares = nil
+	s.holders = nil
+}
+
+// hexBuffer returns share hex encoded in a locked buffer, with a new line
+func hexBuffer(share *memguard.LockedBuffer) *memguard.LockedBuffer {
+	const digits = "0123456789abcdef"
+	encoded := memguard.NewBuffer(share.Size()*2 + 1)
+	for i, b := range share.Bytes() {
+		encoded.Bytes()[i*2] = digits[b>>4]
+		encoded.Bytes()[i*2+1] = digits[b&0x0f]
+	}
+	encoded.Bytes()[share.Size()*2] = '\n'
+	encoded.Freeze()
+	return encoded
+}
+
+// unhexBuffer decodes the hex of encoded in a locked buffer, surrounding spaces are ignored
+func unhexBuffer(encoded *memguard.LockedBuffer) (*memguard.LockedBuffer, error) {
+	hex := bytes.TrimSpace(encoded.Bytes())
+	if len(hex) == 0 || len(hex)%2 != 0 {
+		return nil, errs.With("Share must be an even number of hex digits")
+	}
+	decoded := memguard.NewBuffer(len(hex) / 2)
+	for i := 0; i < len(hex); i += 2 {
+		if !isHex(hex[i]) || !isHex(hex[i+1]) {
+			decoded.Destroy()
+			return nil, errs.With("Share is not hex encoded")
+		}
+		decoded.Bytes()[i/2] = unhex(hex[i])<<4 | unhex(hex[i+1])
+	}
+	decoded.Freeze()
+	return decoded, nil
+}
+
+/////////////////////
+
+// gfEvaluate returns the value at x of the polynomial of coefficients, lowest degree first
+func gfEvaluate(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coefficients[i]
+	}
+	return y
+}
+
+// gfInterpolateZero returns the value at 0 of the polynomial going through the points (xs, ys)
+func gfInterpolateZero(xs []byte, ys []byte) byte {
+	var result byte
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i != j {
+				basis = gfMul(basis, gfMul(xs[j], gfInverse(xs[j]^xs[i])))
+			}
+		}
+		result ^= gfMul(ys[i], basis)
+	}
+	return result
+}
+
+// gfMul multiplies in GF(256) with the AES polynomial, without branching on the values
+func gfMul(a byte, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = a<<1 ^ -(a>>7)&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// gfInverse is a^254, 0 for 0
+func gfInverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 7; i++ {
+		a = gfMul(a, a)
+		result = gfMul(result, a)
+	}
+	return result
+}
@@ -0,0 +1,188 @@
+package memguarded
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shareBytes(shares []*memguard.LockedBuffer, indexes ...int) [][]byte {
+	selected := [][]byte{}
+	for _, i := range indexes {
+		selected = append(selected, shares[i].Bytes())
+	}
+	return selected
+}
+
+func TestSplitSecret_AnyThresholdRebuilds(t *testing.T) {
+	secret := []byte("the production signing key")
+	shares, err := SplitSecret(secret, 5, 3)
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+	for _, share := range shares {
+		assert.False(t, bytes.Contains(share.Bytes(), secret[:4]))
+	}
+
+	for _, indexes := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		combined, err := CombineShares(shareBytes(shares, indexes...))
+		require.NoError(t, err, "shares %v", indexes)
+		assert.Equal(t, secret, combined.Bytes())
+		combined.Destroy()
+	}
+
+	_, err = CombineShares(shareBytes(shares, 0, 1))
+	assert.Error(t, err, "under the threshold")
+	_, err = CombineShares(shareBytes(shares, 0, 0, 1))
+	assert.Error(t, err, "duplicate")
+
+	tampered := append([]byte{}, shares[0].Bytes()...)
+	tampered[0] ^= 1
+	_, err = CombineShares([][]byte{tampered, shares[1].Bytes(), shares[2].Bytes()})
+	assert.Error(t, err, "tampered")
+}
+
+func TestCombineShares_RefusesShareAtZero(t *testing.T) {
+	shares, err := SplitSecret([]byte("s3cret"), 3, 2)
+	require.NoError(t, err)
+
+	chosen := []byte("chosen")
+	check := sha256.Sum256(chosen)
+	forged := append(append(append([]byte{}, chosen...), check[:shamirCheckSize]...), 0)
+	_, err = CombineShares([][]byte{forged, shares[0].Bytes()})
+	assert.Error(t, err)
+
+	submitted := &Shares{Threshold: 2, Unseal: func(secret *memguard.LockedBuffer) error {
+		t.Fatal("forged share unsealed")
+		return nil
+	}}
+	_, err = submitted.Submit(memguard.NewBufferFromBytes(forged), "mallory")
+	assert.Equal(t, StatusInvalidArgument, statusOf(err).Status)
+	received, _ := submitted.Progress()
+	assert.Equal(t, 0, received, "refused share is not stored")
+}
+
+func TestSplitSecret_InvalidParameters(t *testing.T) {
+	for _, params := range [][2]int{{1, 1}, {3, 4}, {256, 2}} {
+		_, err := SplitSecret([]byte("secret"), params[0], params[1])
+		assert.Error(t, err, "count %d threshold %d", params[0], params[1])
+	}
+	_, err := SplitSecret(nil, 3, 2)
+	assert.Error(t, err)
+}
+
+func TestGfInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), gfMul(byte(a), gfInverse(byte(a))), "a=%d", a)
+	}
+}
+
+func TestHexBuffer(t *testing.T) {
+	share := memguard.NewBufferFromBytes([]byte{0x00, 0xab, 0x10, 0xff})
+	encoded := hexBuffer(share)
+	assert.Equal(t, "00ab10ff\n", string(encoded.Bytes()))
+	decoded, err := unhexBuffer(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0xab, 0x10, 0xff}, decoded.Bytes())
+
+	for _, invalid := range []string{"", "abc", "zz"} {
+		_, err := unhexBuffer(memguard.NewBufferFromBytes([]byte(invalid)))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestShares_Submit(t *testing.T) {
+	split, err := SplitSecret([]byte("s3cret"), 3, 2)
+	require.NoError(t, err)
+	other, err := SplitSecret([]byte("other"), 3, 2)
+	require.NoError(t, err)
+
+	var unsealed []byte
+	shares := &Shares{Threshold: 2, Unseal: func(secret *memguard.LockedBuffer) error {
+		unsealed = append([]byte{}, secret.Bytes()...)
+		return nil
+	}}
+
+	received, err := shares.Submit(split[0], "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 1, received)
+	_, err = shares.Submit(split[1], "alice")
+	assert.Error(t, err, "same holder")
+
+	_, err = shares.Submit(other[1], "bob")
+	assert.Error(t, err, "share of another split")
+	received, _ = shares.Progress()
+	assert.Equal(t, 0, received, "failed shares are forgotten")
+
+	_, err = shares.Submit(split[2], "bob")
+	require.NoError(t, err)
+	received, err = shares.Submit(split[0], "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 0, received)
+	assert.Equal(t, []byte("s3cret"), unsealed)
+}
+
+func TestServer_SubmitShareUnsealsSnapshot(t *testing.T) {
+	pki := newTestPKI(t)
+	secondPem, secondKey := filepath.Join(pki.Dir, "second.pem"), filepath.Join(pki.Dir, "second.key")
+	pki.issue(t, secondPem, secondKey, "second", x509.ExtKeyUsageClientAuth)
+
+	key := memguard.NewBufferRandom(32)
+	defer key.Destroy()
+	split, err := SplitSecret(key.Bytes(), 3, 2)
+	require.NoError(t, err)
+
+	store := NewStore()
+	snapshot := &Snapshot{File: filepath.Join(pki.Dir, "snapshot")}
+	snapshot.Init(store)
+	server := runTestServer(t, &Server{
+		SocketPath: filepath.Join(pki.Dir, "test.sock"),
+		CertPem:    pki.ServerPem,
+		CertKey:    pki.ServerKey,
+		CAPem:      pki.CAPem,
+		Snapshot:   snapshot,
+		Shares: &Shares{Threshold: 2, Unseal: func(key *memguard.LockedBuffer) error {
+			_, err := snapshot.unseal(key, snapshotKdfKey, true)
+			return err
+		}},
+	}, store)
+
+	submit := func(client *Client, share *memguard.LockedBuffer) (int, error) {
+		service := NewService()
+		copied := memguard.NewBuffer(share.Size())
+		copied.Copy(share.Bytes())
+		service.setAndNotify(copied)
+		received, _, err := client.SubmitShare(service)
+		return received, err
+	}
+
+	first := newTestClient(t, pki, server)
+	status, err := first.Status()
+	require.NoError(t, err)
+	assert.True(t, *status.Sealed)
+	assert.Equal(t, &SharesStatus{Received: 0, Threshold: 2}, status.Shares)
+
+	received, err := submit(first, split[0])
+	require.NoError(t, err)
+	assert.Equal(t, 1, received)
+	_, err = submit(first, split[1])
+	assert.Equal(t, StatusInvalidArgument, statusOf(err).Status)
+
+	second := testClient(pki, server)
+	second.CertPem, second.CertKey = secondPem, secondKey
+	require.NoError(t, second.Connect())
+	defer second.Close()
+	received, err = submit(second, split[2])
+	require.NoError(t, err)
+	assert.Equal(t, 0, received)
+
+	status, err = second.Status()
+	require.NoError(t, err)
+	assert.False(t, *status.Sealed)
+	assert.Equal(t, &SharesStatus{Received: 0, Threshold: 2}, status.Shares)
+}
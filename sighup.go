@@ -0,0 +1,40 @@
+package memguarded
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// SighupService calls Reload each time the process receives SIGHUP
+type SighupService struct {
+	Reload func() error
+
+	stop chan struct{}
+}
+
+func (s *SighupService) Init() {
+	s.stop = make(chan struct{})
+}
+
+func (s *SighupService) Start() error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			logs.Info("Received SIGHUP, reloading")
+			_ = s.Reload()
+		case <-s.stop:
+			return nil
+		}
+	}
+}
+
+func (s *SighupService) Stop(e error) {
+	close(s.stop)
+}
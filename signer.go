@@ -0,0 +1,100 @@
+package memguarded
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"io"
+	"math/big"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// enclaveSigner is a crypto.Signer whose PKCS#8 private key lives sealed in a memguard enclave.
+// The key is opened and parsed for each signature then wiped, as much as the go crypto types let us.
+type enclaveSigner struct {
+	der    *memguard.Enclave
+	public crypto.PublicKey
+}
+
+// newEnclaveSigner seals the PKCS#8 der, which is wiped
+func newEnclaveSigner(der []byte) (*enclaveSigner, error) {
+	buffer := memguard.NewBufferFromBytes(der)
+	defer buffer.Destroy()
+
+	key, err := x509.ParsePKCS8PrivateKey(buffer.Bytes())
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to parse private key")
+	}
+	defer wipePrivateKey(key)
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errs.With("Private key cannot sign")
+	}
+
+	return &enclaveSigner{
+		der:    buffer.Seal(),
+		public: signer.Public(),
+	}, nil
+}
+
+// sealPrivateKey returns a signer of key kept in an enclave, key is wiped
+func sealPrivateKey(key crypto.PrivateKey) (*enclaveSigner, error) {
+	defer wipePrivateKey(key)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to marshal private key")
+	}
+	return newEnclaveSigner(der)
+}
+
+func (s *enclaveSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *enclaveSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	buffer, err := s.der.Open()
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to open private key enclave")
+	}
+	defer buffer.Destroy()
+
+	key, err := x509.ParsePKCS8PrivateKey(buffer.Bytes())
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to parse private key")
+	}
+	defer wipePrivateKey(key)
+	return key.(crypto.Signer).Sign(rand, digest, opts)
+}
+
+// wipePrivateKey zeroes the private parts of key
+func wipePrivateKey(key crypto.PrivateKey) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		wipeBigInt(key.D)
+		for _, prime := range key.Primes {
+			wipeBigInt(prime)
+		}
+		wipeBigInt(key.Precomputed.Dp)
+		wipeBigInt(key.Precomputed.Dq)
+		wipeBigInt(key.Precomputed.Qinv)
+	case *ecdsa.PrivateKey:
+		wipeBigInt(key.D)
+	case ed25519.PrivateKey:
+		memguard.WipeBytes(key)
+	}
+}
+
+func wipeBigInt(i *big.Int) {
+	if i == nil {
+		return
+	}
+	words := i.Bits()
+	for j := range words {
+		words[j] = 0
+	}
+	i.SetInt64(0)
+}
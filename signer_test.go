@@ -0,0 +1,111 @@
+package memguarded
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func isWiped(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEnclaveSigner_WipesDERAndSigns(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("message"))
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		sign   func(signer crypto.Signer) ([]byte, error)
+		verify func(signature []byte) bool
+	}{
+		{"rsa pkcs1v15", rsaKey,
+			func(signer crypto.Signer) ([]byte, error) { return signer.Sign(rand.Reader, digest[:], crypto.SHA256) },
+			func(signature []byte) bool {
+				return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature) == nil
+			}},
+		{"rsa pss", rsaKey,
+			func(signer crypto.Signer) ([]byte, error) {
+				return signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthEqualsHash})
+			},
+			func(signature []byte) bool {
+				return rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature, nil) == nil
+			}},
+		{"ecdsa", ecdsaKey,
+			func(signer crypto.Signer) ([]byte, error) { return signer.Sign(rand.Reader, digest[:], crypto.SHA256) },
+			func(signature []byte) bool { return ecdsa.VerifyASN1(&ecdsaKey.PublicKey, digest[:], signature) }},
+		{"ed25519", ed25519Key,
+			func(signer crypto.Signer) ([]byte, error) {
+				return signer.Sign(rand.Reader, []byte("message"), crypto.Hash(0))
+			},
+			func(signature []byte) bool {
+				return ed25519.Verify(ed25519Key.Public().(ed25519.PublicKey), []byte("message"), signature)
+			}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			der, err := x509.MarshalPKCS8PrivateKey(test.key)
+			require.NoError(t, err)
+
+			signer, err := newEnclaveSigner(der)
+			require.NoError(t, err)
+			assert.True(t, isWiped(der), "plaintext der is not wiped")
+			assert.True(t, signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(test.key.Public()))
+
+			signature, err := test.sign(signer)
+			require.NoError(t, err)
+			assert.True(t, test.verify(signature))
+		})
+	}
+}
+
+func TestX509KeyPair_KeepsKeyInEnclave(t *testing.T) {
+	pki := newTestPKI(t)
+
+	cert, err := loadX509KeyPair(pki.ClientPem, pki.ClientKey, nil)
+	require.NoError(t, err)
+	_, ok := cert.PrivateKey.(*enclaveSigner)
+	assert.True(t, ok, "private key is not sealed")
+}
+
+func TestX509KeyPair_EncryptedWithoutPassphrase(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyPem := pbes2Format("aes256cbc", pkcs8Opts).encode(t, key, []byte("passphrase"))
+
+	_, err = X509KeyPair(testSelfSigned(t, key), keyPem, nil)
+	assert.Error(t, err)
+}
+
+func TestWipePrivateKey(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	wipePrivateKey(ecdsaKey)
+	assert.Equal(t, 0, ecdsaKey.D.Sign())
+
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	wipePrivateKey(ed25519Key)
+	assert.True(t, isWiped(ed25519Key))
+}
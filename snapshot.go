@@ -0,0 +1,431 @@
+package memguarded
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"github.com/n0rad/go-erlog/logs"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Snapshot file format, the header is authenticated with the secrets:
+//
+//	header  = magic uint8(version) uint8(kdf) [salt(16) uint32(time) uint32(memory KiB) uint8(threads)]
+//	file    = header nonce(24) xchacha20poly1305(secrets)
+//	secrets = (frame(name) uint64(set at unix nano) uint64(ttl) uint64(idle ttl) frame(secret))*
+const (
+	snapshotVersion   = 1
+	snapshotKdfArgon2 = 1
+	snapshotKdfKey    = 2
+
+	snapshotSaltSize = 16
+	argon2Time       = 3
+	argon2Memory     = 64 * 1024
+	argon2Threads    = 4
+
+	// bounds of the parameters read from a snapshot, so a crafted file cannot crash the server or exhaust its memory
+	argon2MaxTime    = 16
+	argon2MaxMemory  = 1024 * 1024
+	argon2MaxThreads = 64
+)
+
+var snapshotMagic = []byte("mgds")
+
+// Snapshot keeps the secrets of a store in a file encrypted with a key derived from a passphrase (Argon2id)
+// or with a wrapping key, so a restart does not lose them.
+// Until unsealed, it does not know the key and leaves the file untouched.
+type Snapshot struct {
+	File    string
+	KeyFile string // 32 bytes wrapping key unsealing at start, instead of a passphrase
+
+	store  *Store
+	key    *memguard.Enclave
+	header []byte
+	lock   sync.Mutex
+	stop   chan struct{}
+}
+
+func (s *Snapshot) Init(store *Store) {
+	s.store = store
+	s.stop = make(chan struct{})
+}
+
+// Start unseals with KeyFile if set, then saves the snapshot on every change of the store
+func (s *Snapshot) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := s.store.Subscribe(ctx, 64)
+
+	if s.KeyFile != "" {
+		key, err := readWrappingKey(s.KeyFile)
+		if err != nil {
+			return err
+		}
+		_, err = s.unseal(key, snapshotKdfKey, true)
+		key.Destroy()
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-sub.Events():
+			if err := s.Save(); err != nil {
+				logs.WithE(err).Error("Failed to save snapshot")
+			}
+		case <-s.stop:
+			return nil
+		}
+	}
+}
+
+func (s *Snapshot) Stop(e error) {
+	close(s.stop)
+}
+
+// Sealed is true until the key of the snapshot is known
+func (s *Snapshot) Sealed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.key == nil
+}
+
+// Unseal derives the key from passphrase and restores the secrets of the file not already set in the store.
+// With create, a missing file is created instead of refused. It returns the number of secrets restored.
+func (s *Snapshot) Unseal(passphrase *memguard.LockedBuffer, create bool) (int, error) {
+	return s.unseal(passphrase, snapshotKdfArgon2, create)
+}
+
+// Save writes the secrets of the store, nothing is done while sealed
+func (s *Snapshot) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.key == nil {
+		logs.WithField("file", s.File).Debug("Snapshot is sealed, not saving")
+		return nil
+	}
+	return s.write()
+}
+
+/////////////////////
+
+// unseal opens the file with secret, a passphrase or a wrapping key depending on kdf
+func (s *Snapshot) unseal(secret *memguard.LockedBuffer, kdf byte, create bool) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.key != nil {
+		return 0, newStatusError(StatusInvalidArgument, "Snapshot is already unsealed")
+	}
+
+	content, err := os.ReadFile(s.File)
+	if os.IsNotExist(err) {
+		if !create {
+			return 0, errs.WithEF(ErrSecretNotSet, data.WithField("file", s.File), "No snapshot to unseal")
+		}
+		if s.header, err = newSnapshotHeader(kdf); err != nil {
+			return 0, err
+		}
+		if s.key, err = snapshotKey(secret, s.header); err != nil {
+			return 0, err
+		}
+		logs.WithField("file", s.File).Info("Snapshot created")
+		return 0, s.write()
+	}
+	if err != nil {
+		return 0, errs.WithEF(err, data.WithField("file", s.File), "Failed to read snapshot")
+	}
+
+	header, err := parseSnapshotHeader(content)
+	if err != nil {
+		return 0, errs.WithEF(err, data.WithField("file", s.File), "Invalid snapshot")
+	}
+	if header[len(snapshotMagic)+1] != kdf {
+		return 0, errs.WithF(data.WithField("file", s.File), "Snapshot is not sealed with this kind of key")
+	}
+	key, err := snapshotKey(secret, header)
+	if err != nil {
+		return 0, err
+	}
+	secrets, err := openSnapshot(key, header, content[len(header):])
+	if err != nil {
+		return 0, errs.WithEF(err, data.WithField("file", s.File), "Failed to unseal snapshot")
+	}
+	defer secrets.Destroy()
+
+	restored, err := s.restore(secrets.Bytes())
+	if err != nil {
+		return 0, errs.WithEF(err, data.WithField("file", s.File), "Invalid snapshot content")
+	}
+	s.key = key
+	s.header = header
+	logs.WithF(data.WithField("file", s.File).WithField("restored", restored)).Info("Snapshot unsealed")
+	return restored, nil
+}
+
+// restore sets the secrets not expired and not already set in the store
+func (s *Snapshot) restore(secrets []byte) (int, error) {
+	restored := 0
+	reader := bytes.NewReader(secrets)
+	for reader.Len() > 0 {
+		name, err := readFrame(reader, maxFrameSize)
+		if err != nil {
+			return restored, err
+		}
+		times := make([]uint64, 3)
+		if err := binary.Read(reader, binary.BigEndian, times); err != nil {
+			return restored, err
+		}
+		secret, err := readPayload(reader)
+		if err != nil {
+			return restored, err
+		}
+		if secret == nil {
+			continue
+		}
+
+		setAt := time.Unix(0, int64(times[0]))
+		ttl := time.Duration(times[1])
+		service := s.store.Service(string(name))
+		if service.IsSet() || (ttl > 0 && time.Now().After(setAt.Add(ttl))) {
+			secret.Destroy()
+			continue
+		}
+		service.restore(secret, setAt, ttl, time.Duration(times[2]))
+		restored++
+	}
+	return restored, nil
+}
+
+// write must be called with the lock held
+func (s *Snapshot) write() error {
+	secrets, err := s.encodeSecrets()
+	if err != nil {
+		return err
+	}
+	defer secrets.Destroy()
+
+	key, err := s.key.Open()
+	if err != nil {
+		return errs.WithE(err, "Failed to open snapshot key")
+	}
+	defer key.Destroy()
+	aead, err := chacha20poly1305.NewX(key.Bytes())
+	if err != nil {
+		return errs.WithE(err, "Failed to create snapshot cipher")
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return errs.WithE(err, "Failed to generate snapshot nonce")
+	}
+	content := append(append([]byte{}, s.header...), nonce...)
+	content = aead.Seal(content, nonce, secrets.Bytes(), s.header)
+	return writeFileAtomic(s.File, content)
+}
+
+// encodeSecrets returns the secrets currently set in a locked buffer
+func (s *Snapshot) encodeSecrets() (*memguard.LockedBuffer, error) {
+	type entry struct {
+		name   string
+		times  []uint64
+		secret *memguard.LockedBuffer
+	}
+	var entries []entry
+	destroy := func() {
+		for _, e := range entries {
+			e.secret.Destroy()
+		}
+	}
+
+	size := 0
+	var openErr error
+	s.store.each(func(name string, service *Service) {
+		enclave, setAt, ttl, idleTTL := service.state()
+		if enclave == nil || openErr != nil {
+			return
+		}
+		secret, err := enclave.Open()
+		if err != nil {
+			openErr = errs.WithEF(err, data.WithField("name", name), "Failed to open secret")
+			return
+		}
+		entries = append(entries, entry{name, []uint64{uint64(setAt.UnixNano()), uint64(ttl), uint64(idleTTL)}, secret})
+		size += 4 + len(name) + 24 + 4 + secret.Size()
+	})
+	if openErr != nil {
+		destroy()
+		return nil, openErr
+	}
+	defer destroy()
+
+	buffer := memguard.NewBuffer(size)
+	offset := 0
+	put := func(b []byte) {
+		buffer.CopyAt(offset, b)
+		offset += len(b)
+	}
+	for _, e := range entries {
+		header := binary.BigEndian.AppendUint32(nil, uint32(len(e.name)))
+		header = append(header, e.name...)
+		for _, t := range e.times {
+			header = binary.BigEndian.AppendUint64(header, t)
+		}
+		header = binary.BigEndian.AppendUint32(header, uint32(e.secret.Size()))
+		put(header)
+		put(e.secret.Bytes())
+	}
+	return buffer, nil
+}
+
+func newSnapshotHeader(kdf byte) ([]byte, error) {
+	header := append(append([]byte{}, snapshotMagic...), snapshotVersion, kdf)
+	if kdf != snapshotKdfArgon2 {
+		return header, nil
+	}
+	salt := make([]byte, snapshotSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errs.WithE(err, "Failed to generate snapshot salt")
+	}
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, argon2Time)
+	header = binary.BigEndian.AppendUint32(header, argon2Memory)
+	return append(header, argon2Threads), nil
+}
+
+// parseSnapshotHeader returns the header part of content
+func parseSnapshotHeader(content []byte) ([]byte, error) {
+	size := len(snapshotMagic) + 2
+	if len(content) < size || !bytes.Equal(content[:len(snapshotMagic)], snapshotMagic) {
+		return nil, errs.With("Not a snapshot file")
+	}
+	if version := content[len(snapshotMagic)]; version != snapshotVersion {
+		return nil, errs.WithF(data.WithField("version", version), "Unsupported snapshot version")
+	}
+	switch content[size-1] {
+	case snapshotKdfArgon2:
+		size += snapshotSaltSize + 9
+		if len(content) < size {
+			return nil, errs.With("Snapshot is truncated")
+		}
+		if err := checkArgon2Params(content[size-9 : size]); err != nil {
+			return nil, err
+		}
+	case snapshotKdfKey:
+	default:
+		return nil, errs.WithF(data.WithField("kdf", content[size-1]), "Unsupported snapshot key derivation")
+	}
+	if len(content) < size+chacha20poly1305.NonceSizeX+chacha20poly1305.Overhead {
+		return nil, errs.With("Snapshot is truncated")
+	}
+	return content[:size:size], nil
+}
+
+// checkArgon2Params refuses the passes, memory and threads of a header out of the supported bounds
+func checkArgon2Params(params []byte) error {
+	passes := binary.BigEndian.Uint32(params)
+	memory := binary.BigEndian.Uint32(params[4:])
+	threads := params[8]
+	if passes < 1 || passes > argon2MaxTime || threads < 1 || threads > argon2MaxThreads ||
+		memory < 8*uint32(threads) || memory > argon2MaxMemory {
+		return errs.WithF(data.WithField("passes", passes).WithField("memory", memory).WithField("threads", threads),
+			"Unsupported snapshot key derivation parameters")
+	}
+	return nil
+}
+
+// snapshotKey derives the key from secret with the parameters of header
+func snapshotKey(secret *memguard.LockedBuffer, header []byte) (*memguard.Enclave, error) {
+	params := header[len(snapshotMagic)+2:]
+	if header[len(snapshotMagic)+1] == snapshotKdfKey {
+		if secret.Size() != chacha20poly1305.KeySize {
+			return nil, errs.WithF(data.WithField("size", secret.Size()), "Snapshot wrapping key must be 32 bytes")
+		}
+		key := memguard.NewBuffer(chacha20poly1305.KeySize)
+		key.Copy(secret.Bytes())
+		return key.Seal(), nil
+	}
+
+	salt := params[:snapshotSaltSize]
+	passes := binary.BigEndian.Uint32(params[snapshotSaltSize:])
+	memory := binary.BigEndian.Uint32(params[snapshotSaltSize+4:])
+	threads := params[snapshotSaltSize+8]
+	derived := argon2.IDKey(secret.Bytes(), salt, passes, memory, threads, chacha20poly1305.KeySize)
+	return memguard.NewBufferFromBytes(derived).Seal(), nil
+}
+
+// openSnapshot decrypts the secrets directly in a locked buffer
+func openSnapshot(key *memguard.Enclave, header []byte, sealed []byte) (*memguard.LockedBuffer, error) {
+	opened, err := key.Open()
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to open snapshot key")
+	}
+	defer opened.Destroy()
+	aead, err := chacha20poly1305.NewX(opened.Bytes())
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to create snapshot cipher")
+	}
+
+	nonce, ciphertext := sealed[:chacha20poly1305.NonceSizeX], sealed[chacha20poly1305.NonceSizeX:]
+	// opened in place, the buffer has the exact size of the plaintext
+	secrets := memguard.NewBuffer(len(ciphertext) - aead.Overhead())
+	if _, err := aead.Open(secrets.Bytes()[:0], nonce, ciphertext, header); err != nil {
+		secrets.Destroy()
+		return nil, newStatusError(StatusUnauthorized, "Wrong key or corrupted snapshot")
+	}
+	return secrets, nil
+}
+
+func readWrappingKey(file string) (*memguard.LockedBuffer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errs.WithEF(err, data.WithField("file", file), "Failed to open snapshot key file")
+	}
+	defer f.Close()
+
+	key, err := memguard.NewBufferFromEntireReader(io.LimitReader(f, chacha20poly1305.KeySize+1))
+	if err != nil {
+		key.Destroy()
+		return nil, errs.WithEF(err, data.WithField("file", file), "Failed to read snapshot key file")
+	}
+	return key, nil
+}
+
+// writeFileAtomic replaces file with content through a temporary file, so a crash never leaves it half written
+func writeFileAtomic(file string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", file), "Failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errs.WithEF(err, data.WithField("file", tmp.Name()), "Failed to write temporary file")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errs.WithEF(err, data.WithField("file", tmp.Name()), "Failed to sync temporary file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errs.WithEF(err, data.WithField("file", tmp.Name()), "Failed to close temporary file")
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return errs.WithEF(err, data.WithField("file", file), "Failed to replace file")
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package memguarded
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSnapshotPassphrase(value string) *memguard.LockedBuffer {
+	return memguard.NewBufferFromBytes([]byte(value))
+}
+
+func setTestSecret(t *testing.T, service *Service, value string) {
+	b := []byte(value)
+	require.NoError(t, service.FromBytes(&b))
+}
+
+func TestSnapshot_UnsealRestoresSecrets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "snapshot")
+	store := NewStore()
+	snapshot := &Snapshot{File: file}
+	snapshot.Init(store)
+
+	setTestSecret(t, store.Service("db"), "s3cret")
+	store.Service("api").SetTTL(time.Hour)
+	setTestSecret(t, store.Service("api"), "t0ken")
+	store.Service("empty")
+	require.NoError(t, snapshot.Save())
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err), "sealed snapshot must not be written")
+
+	passphrase := testSnapshotPassphrase("correct horse")
+	defer passphrase.Destroy()
+	_, err = snapshot.Unseal(passphrase, false)
+	assert.Equal(t, StatusNotSet, statusOf(err).Status)
+	restored, err := snapshot.Unseal(passphrase, true)
+	require.NoError(t, err)
+	assert.Equal(t, 0, restored)
+	assert.False(t, snapshot.Sealed())
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(content, []byte("s3cret")))
+	assert.False(t, bytes.Contains(content, []byte("db")))
+
+	other := NewStore()
+	setTestSecret(t, other.Service("db"), "newer")
+	reopened := &Snapshot{File: file}
+	reopened.Init(other)
+	wrong := testSnapshotPassphrase("wrong horse")
+	defer wrong.Destroy()
+	_, err = reopened.Unseal(wrong, false)
+	assert.Equal(t, StatusUnauthorized, statusOf(err).Status)
+	assert.True(t, reopened.Sealed())
+
+	restored, err = reopened.Unseal(passphrase, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	assert.Equal(t, []string{"api", "db"}, other.Names())
+	assert.Equal(t, "newer", secretOf(t, other.Service("db")))
+	assert.Equal(t, "t0ken", secretOf(t, other.Service("api")))
+	assert.Equal(t, time.Hour, other.Service("api").TTL())
+	expiresAt, ok := other.Service("api").ExpiresAt()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+
+	_, err = reopened.Unseal(passphrase, false)
+	assert.Error(t, err)
+}
+
+func TestSnapshot_RefusesCraftedKdfParameters(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "snapshot")
+	snapshot := &Snapshot{File: file}
+	snapshot.Init(NewStore())
+	passphrase := testSnapshotPassphrase("correct horse")
+	defer passphrase.Destroy()
+	_, err := snapshot.Unseal(passphrase, true)
+	require.NoError(t, err)
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+
+	params := len(snapshotMagic) + 2 + snapshotSaltSize
+	for name, patch := range map[string]func(header []byte){
+		"no pass":     func(header []byte) { binary.BigEndian.PutUint32(header[params:], 0) },
+		"huge memory": func(header []byte) { binary.BigEndian.PutUint32(header[params+4:], 0xffffffff) },
+		"no thread":   func(header []byte) { header[params+8] = 0 },
+	} {
+		crafted := append([]byte{}, content...)
+		patch(crafted)
+		require.NoError(t, os.WriteFile(file, crafted, 0600))
+
+		reopened := &Snapshot{File: file}
+		reopened.Init(NewStore())
+		_, err := reopened.Unseal(passphrase, false)
+		assert.Error(t, err, name)
+		assert.True(t, reopened.Sealed(), name)
+	}
+}
+
+func TestSnapshot_SkipsExpiredSecrets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "snapshot")
+	store := NewStore()
+	snapshot := &Snapshot{File: file}
+	snapshot.Init(store)
+	passphrase := testSnapshotPassphrase("correct horse")
+	defer passphrase.Destroy()
+	_, err := snapshot.Unseal(passphrase, true)
+	require.NoError(t, err)
+
+	setTestSecret(t, store.Service("short"), "gone")
+	setTestSecret(t, store.Service("long"), "kept")
+	store.Service("short").SetTTL(50 * time.Millisecond)
+	require.NoError(t, snapshot.Save())
+	time.Sleep(100 * time.Millisecond)
+
+	other := NewStore()
+	reopened := &Snapshot{File: file}
+	reopened.Init(other)
+	restored, err := reopened.Unseal(passphrase, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	assert.Equal(t, []string{"long"}, other.Names())
+}
+
+func TestSnapshot_KeyFileSavesOnChange(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "snapshot")
+	keyFile := filepath.Join(dir, "snapshot.key")
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, key, 0600))
+
+	start := func(store *Store) *Snapshot {
+		snapshot := &Snapshot{File: file, KeyFile: keyFile}
+		snapshot.Init(store)
+		done := make(chan error, 1)
+		go func() { done <- snapshot.Start() }()
+		t.Cleanup(func() {
+			snapshot.Stop(nil)
+			require.NoError(t, <-done)
+		})
+		for deadline := time.Now().Add(5 * time.Second); snapshot.Sealed(); time.Sleep(10 * time.Millisecond) {
+			require.True(t, time.Now().Before(deadline), "snapshot not unsealed")
+		}
+		return snapshot
+	}
+
+	store := NewStore()
+	start(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := store.Subscribe(ctx, 1)
+	setTestSecret(t, store.Service(DefaultSecretName), "s3cret")
+	<-sub.Events()
+
+	other := NewStore()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		reopened := &Snapshot{File: file}
+		reopened.Init(other)
+		wrapping, err := readWrappingKey(keyFile)
+		require.NoError(t, err)
+		restored, err := reopened.unseal(wrapping, snapshotKdfKey, false)
+		wrapping.Destroy()
+		require.NoError(t, err)
+		if restored == 1 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "secret not saved")
+	}
+	assert.Equal(t, "s3cret", secretOf(t, other.Service(DefaultSecretName)))
+
+	passphrase := testSnapshotPassphrase("correct horse")
+	defer passphrase.Destroy()
+	_, err = (&Snapshot{File: file, store: NewStore()}).Unseal(passphrase, false)
+	assert.Error(t, err, "a wrapping key snapshot cannot be unsealed with a passphrase")
+
+	require.NoError(t, os.WriteFile(keyFile, key[:16], 0600))
+	short := &Snapshot{File: file, KeyFile: keyFile}
+	short.Init(NewStore())
+	assert.Error(t, short.Start())
+}
+
+func TestServer_Unseal(t *testing.T) {
+	pki := newTestPKI(t)
+	file := filepath.Join(pki.Dir, "snapshot")
+	passphrase := NewService()
+	setTestSecret(t, passphrase, "correct horse")
+
+	start := func(socket string) (*Server, *Snapshot) {
+		store := NewStore()
+		snapshot := &Snapshot{File: file}
+		snapshot.Init(store)
+		server := runTestServer(t, &Server{
+			SocketPath: filepath.Join(pki.Dir, socket),
+			CertPem:    pki.ServerPem,
+			CertKey:    pki.ServerKey,
+			CAPem:      pki.CAPem,
+			Snapshot:   snapshot,
+		}, store)
+		return server, snapshot
+	}
+
+	server, snapshot := start("first.sock")
+	client := newTestClient(t, pki, server)
+	_, err := client.Unseal(passphrase, false)
+	assert.True(t, errors.Is(err, ErrSecretNotSet))
+	client = newTestClient(t, pki, server)
+	restored, err := client.Unseal(passphrase, true)
+	require.NoError(t, err)
+	assert.Equal(t, 0, restored)
+	secret := NewService()
+	setTestSecret(t, secret, "s3cret")
+	require.NoError(t, client.SetNamedSecret("db", secret))
+	require.NoError(t, snapshot.Save())
+
+	server, _ = start("second.sock")
+	client = newTestClient(t, pki, server)
+	restored, err = client.Unseal(passphrase, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	got := NewService()
+	require.NoError(t, client.GetNamedSecret("db", got))
+	assert.Equal(t, "s3cret", secretOf(t, got))
+}
@@ -0,0 +1,146 @@
+package memguarded
+
+import (
+	"io"
+	"os"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/data"
+	"github.com/n0rad/go-erlog/errs"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// SecretSource tells where to read a secret instead of asking it on the terminal.
+// At most one source can be set, the secret is read up to the first new line.
+type SecretSource struct {
+	Reader io.Reader // like a file descriptor given by the parent process
+	File   string
+	Shred  bool   // overwrite and remove File once read
+	Env    string // variable unset once read, the go runtime keeps its own copy of the environment
+	Stdin  bool   // stdin must not be a terminal
+}
+
+func (s SecretSource) count() int {
+	count := 0
+	for _, set := range []bool{s.Reader != nil, s.File != "", s.Env != "", s.Stdin} {
+		if set {
+			count++
+		}
+	}
+	return count
+}
+
+// FromSource reads the secret from source, or asks it when no source is set.
+// A secret read from a source must pass the checks of options at once.
+func (s *Service) FromSource(source SecretSource, name string, options AskOptions) error {
+	switch source.count() {
+	case 0:
+		return s.AskSecretWithOptions(name, options)
+	case 1:
+	default:
+		return errs.WithF(data.WithField("name", name), "Only one source can be given")
+	}
+
+	var buffer *memguard.LockedBuffer
+	var err error
+	switch {
+	case source.Reader != nil:
+		buffer, err = readUntilNewLine(source.Reader)
+	case source.File != "":
+		buffer, err = readFileSource(source.File, source.Shred)
+	case source.Env != "":
+		value := []byte(os.Getenv(source.Env))
+		if err = os.Unsetenv(source.Env); err != nil {
+			memguard.WipeBytes(value)
+			return errs.WithEF(err, data.WithField("env", source.Env), "Failed to unset env variable")
+		}
+		if len(value) > 0 {
+			buffer = memguard.NewBufferFromBytes(value)
+		}
+	case source.Stdin:
+		if terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return errs.WithF(data.WithField("name", name), "Stdin is a terminal, not a pipe")
+		}
+		buffer, err = readUntilNewLine(os.Stdin)
+	}
+	if err != nil {
+		return errs.WithEF(err, data.WithField("name", name), "Failed to read secret")
+	}
+	if buffer == nil {
+		return errs.WithF(data.WithField("name", name), "Secret is empty")
+	}
+	if message := options.check(buffer, options.Texts.withDefaults(name)); message != "" {
+		buffer.Destroy()
+		return errs.WithF(data.WithField("name", name), message)
+	}
+
+	s.setAndNotify(buffer)
+	return nil
+}
+
+// readUntilNewLine returns nil if nothing was read before the new line
+func readUntilNewLine(reader io.Reader) (*memguard.LockedBuffer, error) {
+	buffer, err := memguard.NewBufferFromReaderUntil(reader, '\n')
+	if err != nil && err != io.EOF {
+		buffer.Destroy()
+		return nil, err
+	}
+	if buffer.Size() == 0 {
+		buffer.Destroy()
+		return nil, nil
+	}
+	return buffer, nil
+}
+
+func readFileSource(path string, shred bool) (*memguard.LockedBuffer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffer, err := readUntilNewLine(file)
+	if err != nil {
+		return nil, err
+	}
+	if shred {
+		if err := shredFile(path); err != nil {
+			buffer.Destroy()
+			return nil, err
+		}
+	}
+	return buffer, nil
+}
+
+// shredFile overwrites the content of path with zeros before removing it
+func shredFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", path), "Failed to open file to shred")
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return errs.WithEF(err, data.WithField("file", path), "Failed to stat file to shred")
+	}
+	zeros := make([]byte, 4096)
+	for remaining := stat.Size(); remaining > 0; {
+		n := int64(len(zeros))
+		if remaining < n {
+			n = remaining
+		}
+		written, err := file.Write(zeros[:n])
+		if err != nil {
+			return errs.WithEF(err, data.WithField("file", path), "Failed to overwrite file")
+		}
+		remaining -= int64(written)
+	}
+	if err := file.Sync(); err != nil {
+		return errs.WithEF(err, data.WithField("file", path), "Failed to sync shredded file")
+	}
+	if err := os.Remove(path); err != nil {
+		return errs.WithEF(err, data.WithField("file", path), "Failed to remove shredded file")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package memguarded
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func secretOf(t *testing.T, service *Service) string {
+	buffer, err := service.Get()
+	require.NoError(t, err)
+	defer buffer.Destroy()
+	return string(buffer.Bytes())
+}
+
+func TestService_FromSource(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "kept")
+	require.NoError(t, os.WriteFile(kept, []byte("from file\nignored"), 0600))
+	shredded := filepath.Join(dir, "shredded")
+	require.NoError(t, os.WriteFile(shredded, []byte("from shredded file"), 0600))
+	t.Setenv("MEMGUARDED_TEST_SECRET", "from env")
+
+	tests := []struct {
+		name     string
+		source   SecretSource
+		expected string
+	}{
+		{"reader", SecretSource{Reader: strings.NewReader("from reader\nignored")}, "from reader"},
+		{"file", SecretSource{File: kept}, "from file"},
+		{"shredded file", SecretSource{File: shredded, Shred: true}, "from shredded file"},
+		{"env", SecretSource{Env: "MEMGUARDED_TEST_SECRET"}, "from env"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := NewService()
+			require.NoError(t, service.FromSource(test.source, "Secret", AskOptions{}))
+			assert.Equal(t, test.expected, secretOf(t, service))
+		})
+	}
+
+	_, err := os.Stat(kept)
+	assert.NoError(t, err)
+	_, err = os.Stat(shredded)
+	assert.True(t, os.IsNotExist(err))
+	_, ok := os.LookupEnv("MEMGUARDED_TEST_SECRET")
+	assert.False(t, ok)
+}
+
+func TestService_FromSourceErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  SecretSource
+		options AskOptions
+	}{
+		{"many sources", SecretSource{Reader: strings.NewReader("secret"), Env: "HOME"}, AskOptions{}},
+		{"empty reader", SecretSource{Reader: strings.NewReader("\nsecret")}, AskOptions{}},
+		{"missing file", SecretSource{File: filepath.Join(t.TempDir(), "missing")}, AskOptions{}},
+		{"unset env", SecretSource{Env: "MEMGUARDED_TEST_UNSET"}, AskOptions{}},
+		{"too short", SecretSource{Reader: strings.NewReader("secret")}, AskOptions{MinLength: 8}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := NewService()
+			assert.Error(t, service.FromSource(test.source, "Secret", test.options))
+			assert.False(t, service.IsSet())
+		})
+	}
+}
+
+func TestShredFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(file, []byte(strings.Repeat("s", 10000)), 0600))
+
+	// keep a handle to look at the content once the file is removed
+	handle, err := os.Open(file)
+	require.NoError(t, err)
+	defer handle.Close()
+
+	require.NoError(t, shredFile(file))
+	content := make([]byte, 10001)
+	n, _ := handle.Read(content)
+	assert.Equal(t, 10000, n)
+	assert.True(t, isWiped(content[:n]))
+}
@@ -0,0 +1,81 @@
+package memguarded
+
+import (
+	"strconv"
+
+	"github.com/n0rad/go-erlog/errs"
+)
+
+// Status is the outcome of a command, sent back to the client before any response value
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusNotSet
+	StatusUnauthorized
+	StatusUnknownCommand
+	StatusInternal
+	StatusInvalidArgument
+)
+
+var statusNames = map[Status]string{
+	StatusOK:              "OK",
+	StatusNotSet:          "NOT_SET",
+	StatusUnauthorized:    "UNAUTHORIZED",
+	StatusUnknownCommand:  "UNKNOWN_COMMAND",
+	StatusInternal:        "INTERNAL",
+	StatusInvalidArgument: "INVALID_ARGUMENT",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "STATUS_" + strconv.Itoa(int(s))
+}
+
+// Errors returned by the client for a non OK status, to be checked with errors.Is
+var (
+	ErrSecretNotSet    = &StatusError{Status: StatusNotSet}
+	ErrUnauthorized    = &StatusError{Status: StatusUnauthorized}
+	ErrUnknownCommand  = &StatusError{Status: StatusUnknownCommand}
+	ErrInternal        = &StatusError{Status: StatusInternal}
+	ErrInvalidArgument = &StatusError{Status: StatusInvalidArgument}
+)
+
+type StatusError struct {
+	Status  Status
+	Message string
+}
+
+func newStatusError(status Status, message string) *StatusError {
+	return &StatusError{Status: status, Message: message}
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return e.Status.String()
+	}
+	return e.Status.String() + ": " + e.Message
+}
+
+// Is matches any StatusError with the same status
+func (e *StatusError) Is(target error) bool {
+	t, ok := target.(*StatusError)
+	return ok && t.Status == e.Status
+}
+
+// statusOf finds the status carried by err, looking into erlog causes, INTERNAL if none
+func statusOf(err error) *StatusError {
+	switch e := err.(type) {
+	case *StatusError:
+		return e
+	case *errs.EntryError:
+		for _, cause := range e.Errs {
+			if status := statusOf(cause); status.Status != StatusInternal {
+				return status
+			}
+		}
+	}
+	return newStatusError(StatusInternal, "Internal server error")
+}
@@ -0,0 +1,156 @@
+package memguarded
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/awnumar/memguard"
+)
+
+// DefaultSecretName is the name used when no secret name is given
+const DefaultSecretName = "default"
+
+// Store holds many secrets, each in its own Service, keyed by name
+type Store struct {
+	services      map[string]*Service
+	lock          sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+	notifyLock    sync.RWMutex
+	stop          chan struct{}
+}
+
+func NewStore() *Store {
+	s := &Store{}
+	s.Init()
+	return s
+}
+
+func (s *Store) Init() {
+	s.services = make(map[string]*Service)
+	s.subscriptions = make(map[*Subscription]struct{})
+	s.stop = make(chan struct{})
+}
+
+func (s *Store) Start() error {
+	memguard.CatchInterrupt()
+	<-s.stop
+	return nil
+}
+
+func (s *Store) Stop(e error) {
+	close(s.stop)
+}
+
+// Register adds an already existing service under name, replacing any previous one.
+// It must be done before the service is shared since it names its events.
+func (s *Store) Register(name string, service *Service) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	service.name = name
+	service.onChange = s.notifyAll
+	s.services[name] = service
+}
+
+// Service returns the service for name, creating an empty one if needed
+func (s *Store) Service(name string) *Service {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	service, ok := s.services[name]
+	if !ok {
+		service = NewNamedService(name)
+		service.onChange = s.notifyAll
+		s.services[name] = service
+	}
+	return service
+}
+
+// Lookup returns the service for name without creating it
+func (s *Store) Lookup(name string) (*Service, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	service, ok := s.services[name]
+	return service, ok
+}
+
+// Names returns the sorted names of the secrets currently set
+func (s *Store) Names() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	names := []string{}
+	for name, service := range s.services {
+		if service.IsSet() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Delete clears the secret and removes it from the store, returns false if it was not set
+func (s *Store) Delete(name string) bool {
+	s.lock.Lock()
+	service, ok := s.services[name]
+	delete(s.services, name)
+	s.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+	wasSet := service.IsSet()
+	service.Clear()
+	return wasSet
+}
+
+// Subscribe returns a subscription to the events of all the secrets of the store, removed when ctx is done
+func (s *Store) Subscribe(ctx context.Context, buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	sub := &Subscription{events: make(chan Event, buffer)}
+
+	s.notifyLock.Lock()
+	s.subscriptions[sub] = struct{}{}
+	s.notifyLock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		s.notifyLock.Lock()
+		delete(s.subscriptions, sub)
+		s.notifyLock.Unlock()
+		close(sub.events)
+	}()
+	return sub
+}
+
+// each calls f with the services of the store, sorted by name
+func (s *Store) each(f func(name string, service *Service)) {
+	s.lock.RLock()
+	names := make([]string, 0, len(s.services))
+	for name := range s.services {
+		names = append(names, name)
+	}
+	services := make(map[string]*Service, len(s.services))
+	for name, service := range s.services {
+		services[name] = service
+	}
+	s.lock.RUnlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		f(name, services[name])
+	}
+}
+
+func (s *Store) notifyAll(event Event) {
+	s.notifyLock.RLock()
+	defer s.notifyLock.RUnlock()
+
+	for sub := range s.subscriptions {
+		sub.deliver(event)
+	}
+}
@@ -0,0 +1,66 @@
+package memguarded
+
+import (
+	"context"
+	"testing"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_ServiceCreatesOnce(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	store := NewStore()
+	assert.True(t, store.Service("a") == store.Service("a"))
+
+	_, ok := store.Lookup("b")
+	assert.False(t, ok)
+}
+
+func TestStore_NamesOnlyListsSetSecrets(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	store := NewStore()
+	store.Service("empty")
+	b := []byte("value")
+	assert.NoError(t, store.Service("zz").FromBytes(&b))
+	c := []byte("value")
+	assert.NoError(t, store.Service("aa").FromBytes(&c))
+
+	assert.Equal(t, []string{"aa", "zz"}, store.Names())
+}
+
+func TestStore_Delete(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	store := NewStore()
+	b := []byte("value")
+	assert.NoError(t, store.Service(DefaultSecretName).FromBytes(&b))
+
+	assert.True(t, store.Delete(DefaultSecretName))
+	assert.False(t, store.Delete(DefaultSecretName))
+	assert.Empty(t, store.Names())
+}
+
+func TestStore_SubscribeGetsEventsOfAllSecrets(t *testing.T) {
+	memguard.CatchInterrupt()
+
+	store := NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := store.Subscribe(ctx, 4)
+
+	b := []byte("value")
+	assert.NoError(t, store.Service("a").FromBytes(&b))
+	store.Register("b", NewService())
+	store.Service("b").Clear()
+	store.Delete("a")
+
+	expected := []Event{{Kind: EventSet, Name: "a"}, {Kind: EventCleared, Name: "b"}, {Kind: EventCleared, Name: "a"}}
+	for _, e := range expected {
+		event := <-sub.Events()
+		assert.Equal(t, e.Kind, event.Kind)
+		assert.Equal(t, e.Name, event.Name)
+	}
+}
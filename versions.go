@@ -0,0 +1,168 @@
+package memguarded
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/n0rad/go-erlog/logs"
+)
+
+// DefaultHistorySize is the number of previous versions a Service remembers when SetHistorySize is not called
+const DefaultHistorySize = 10
+
+// VersionInfo describes a version of a secret, without its value
+type VersionInfo struct {
+	Version       uint64    `json:"version"`
+	SetAt         time.Time `json:"setAt"`
+	Setter        string    `json:"setter,omitempty"`
+	Current       bool      `json:"current,omitempty"`
+	Readable      bool      `json:"readable"`
+	ReadableUntil time.Time `json:"readableUntil,omitzero"` // end of the grace period of a previous version
+}
+
+// secretVersion is a previous version, its value is only kept during the grace period of a rotation
+type secretVersion struct {
+	info   VersionInfo
+	secret *memguard.Enclave
+	expire *time.Timer
+}
+
+// Rotate promotes a new value, the current one staying readable with GetVersion for grace
+func (s *Service) Rotate(buffer *memguard.LockedBuffer, setter string, grace time.Duration) {
+	s.replace(buffer, setter, grace, EventRotated)
+}
+
+// SetHistorySize bounds the number of previous versions remembered, the oldest are forgotten first.
+// 0 is DefaultHistorySize and a negative size remembers none.
+func (s *Service) SetHistorySize(size int) {
+	s.secretLock.Lock()
+	defer s.secretLock.Unlock()
+
+	s.historySize = size
+	s.trimHistory()
+}
+
+// Version returns the number of the current version, 0 if never set
+func (s *Service) Version() uint64 {
+	s.secretLock.RLock()
+	defer s.secretLock.RUnlock()
+
+	return s.version
+}
+
+// GetVersion opens the current version, or a previous one still in its grace period
+func (s *Service) GetVersion(version uint64) (*memguard.LockedBuffer, error) {
+	s.secretLock.Lock()
+	s.gets++
+	var enclave *memguard.Enclave
+	if version == s.version {
+		s.lastAccess = time.Now()
+		enclave = s.secret
+	}
+	for _, previous := range s.history {
+		if previous.info.Version == version && time.Now().Before(previous.info.ReadableUntil) {
+			enclave = previous.secret
+		}
+	}
+	s.secretLock.Unlock()
+
+	if enclave == nil {
+		return nil, newStatusError(StatusNotSet, "Version "+strconv.FormatUint(version, 10)+" is not readable")
+	}
+	return enclave.Open()
+}
+
+// Versions returns the metadata of the previous versions remembered and of the current one, oldest first
+func (s *Service) Versions() []VersionInfo {
+	s.secretLock.RLock()
+	defer s.secretLock.RUnlock()
+
+	versions := []VersionInfo{}
+	for _, previous := range s.history {
+		info := previous.info
+		info.Readable = previous.secret != nil
+		versions = append(versions, info)
+	}
+	if s.version > 0 {
+		versions = append(versions, VersionInfo{
+			Version:  s.version,
+			SetAt:    s.setAt,
+			Setter:   s.setter,
+			Current:  true,
+			Readable: s.secret != nil,
+		})
+	}
+	return versions
+}
+
+/////
+
+// replace makes buffer the current version, the previous one stays readable for grace if positive
+func (s *Service) replace(buffer *memguard.LockedBuffer, setter string, grace time.Duration, kind EventKind) {
+	logs.Debug("Secret set")
+	s.secretLock.Lock()
+	if s.version > 0 {
+		previous := &secretVersion{info: VersionInfo{Version: s.version, SetAt: s.setAt, Setter: s.setter}}
+		if grace > 0 && s.secret != nil {
+			previous.secret = s.secret
+			previous.info.ReadableUntil = time.Now().Add(grace)
+			previous.expire = time.AfterFunc(grace, func() { s.forgetValue(previous) })
+		}
+		s.history = append(s.history, previous)
+		s.trimHistory()
+	}
+
+	if buffer == nil {
+		s.secret = nil
+	} else {
+		s.secret = buffer.Seal()
+	}
+	s.version++
+	s.setter = setter
+	s.generation++
+	s.setAt = time.Now()
+	s.lastAccess = s.setAt
+	s.scheduleExpiration()
+	s.secretLock.Unlock()
+
+	s.notifyAll(kind)
+}
+
+// forgetValue drops the value of a previous version at the end of its grace period
+func (s *Service) forgetValue(previous *secretVersion) {
+	s.secretLock.Lock()
+	defer s.secretLock.Unlock()
+
+	previous.secret = nil
+	previous.info.ReadableUntil = time.Time{}
+}
+
+// forgetValues drops the values of all previous versions, on clear and expiry. Must be called with the secret lock held
+func (s *Service) forgetValues() {
+	for _, previous := range s.history {
+		if previous.expire != nil {
+			previous.expire.Stop()
+		}
+		previous.secret = nil
+		previous.info.ReadableUntil = time.Time{}
+	}
+}
+
+// trimHistory must be called with the secret lock held
+func (s *Service) trimHistory() {
+	size := s.historySize
+	if size == 0 {
+		size = DefaultHistorySize
+	}
+	if size < 0 {
+		size = 0
+	}
+	for len(s.history) > size {
+		if s.history[0].expire != nil {
+			s.history[0].expire.Stop()
+		}
+		s.history[0].secret = nil
+		s.history = s.history[1:]
+	}
+}
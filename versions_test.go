@@ -0,0 +1,146 @@
+package memguarded
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rotateTestSecret(service *Service, value string, grace time.Duration) {
+	service.Rotate(memguard.NewBufferFromBytes([]byte(value)), "tester", grace)
+}
+
+func assertVersion(t *testing.T, service *Service, version uint64, expected string) {
+	buffer, err := service.GetVersion(version)
+	require.NoError(t, err, "version %d", version)
+	defer buffer.Destroy()
+	assert.Equal(t, expected, string(buffer.Bytes()))
+}
+
+func TestService_RotateKeepsPreviousDuringGrace(t *testing.T) {
+	service := NewService()
+	setTestSecret(t, service, "v1")
+	rotateTestSecret(service, "v2", 50*time.Millisecond)
+
+	assert.Equal(t, uint64(2), service.Version())
+	assertVersion(t, service, 2, "v2")
+	assertVersion(t, service, 1, "v1")
+
+	time.Sleep(100 * time.Millisecond)
+	_, err := service.GetVersion(1)
+	assert.Equal(t, StatusNotSet, statusOf(err).Status)
+	assertVersion(t, service, 2, "v2")
+
+	_, err = service.GetVersion(3)
+	assert.Equal(t, StatusNotSet, statusOf(err).Status)
+}
+
+func TestService_VersionsMetadata(t *testing.T) {
+	service := NewService()
+	setTestSecret(t, service, "v1")
+	rotateTestSecret(service, "v2", time.Hour)
+	rotateTestSecret(service, "v3", 0)
+
+	versions := service.Versions()
+	require.Len(t, versions, 3)
+	assert.Equal(t, uint64(1), versions[0].Version)
+	assert.Equal(t, "", versions[0].Setter)
+	assert.True(t, versions[0].Readable)
+	assert.False(t, versions[0].ReadableUntil.IsZero())
+	assert.Equal(t, uint64(2), versions[1].Version)
+	assert.Equal(t, "tester", versions[1].Setter)
+	assert.False(t, versions[1].Readable, "rotated without grace")
+	assert.True(t, versions[2].Current)
+	assert.True(t, versions[2].Readable)
+	assert.False(t, versions[2].SetAt.IsZero())
+
+	service.Clear()
+	for _, version := range service.Versions() {
+		assert.False(t, version.Readable, "version %d", version.Version)
+	}
+	_, err := service.GetVersion(1)
+	assert.Error(t, err)
+}
+
+func TestService_ExpiryForgetsPreviousVersions(t *testing.T) {
+	service := NewService()
+	setTestSecret(t, service, "v1")
+	rotateTestSecret(service, "v2", time.Hour)
+	assertVersion(t, service, 1, "v1")
+
+	service.SetTTL(50 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, service.IsSet())
+	_, err := service.GetVersion(1)
+	assert.Equal(t, StatusNotSet, statusOf(err).Status)
+	for _, version := range service.Versions() {
+		assert.False(t, version.Readable, "version %d", version.Version)
+	}
+}
+
+func TestService_HistoryIsBounded(t *testing.T) {
+	service := NewService()
+	service.SetHistorySize(2)
+	for _, value := range []string{"v1", "v2", "v3", "v4"} {
+		rotateTestSecret(service, value, time.Hour)
+	}
+
+	versions := service.Versions()
+	require.Len(t, versions, 3)
+	assert.Equal(t, uint64(2), versions[0].Version)
+	_, err := service.GetVersion(1)
+	assert.Error(t, err)
+	assertVersion(t, service, 3, "v3")
+
+	service.SetHistorySize(-1)
+	assert.Len(t, service.Versions(), 1)
+}
+
+func TestServer_RotateSecret(t *testing.T) {
+	pki := newTestPKI(t)
+	store := NewStore()
+	server := runTestServer(t, &Server{
+		SocketPath:    filepath.Join(pki.Dir, "rotate.sock"),
+		CertPem:       pki.ServerPem,
+		CertKey:       pki.ServerKey,
+		CAPem:         pki.CAPem,
+		RotationGrace: time.Minute,
+	}, store)
+	client := newTestClient(t, pki, server)
+
+	first := NewService()
+	setTestSecret(t, first, "v1")
+	require.NoError(t, client.SetNamedSecret("db", first))
+	second := NewService()
+	setTestSecret(t, second, "v2")
+	version, err := client.RotateNamedSecret("db", second, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), version)
+
+	got := NewService()
+	require.NoError(t, client.GetNamedSecretVersion("db", 1, got))
+	assert.Equal(t, "v1", getTestSecret(t, got))
+	require.NoError(t, client.GetNamedSecret("db", got))
+	assert.Equal(t, "v2", getTestSecret(t, got))
+
+	versions, err := client.SecretVersions("db")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, "cn=client", versions[0].Setter)
+	assert.True(t, versions[0].Readable)
+	assert.True(t, versions[1].Current)
+
+	err = client.GetNamedSecretVersion("db", 5, got)
+	assert.Equal(t, StatusNotSet, statusOf(err).Status)
+}
+
+func getTestSecret(t *testing.T, service *Service) string {
+	buffer, err := service.Get()
+	require.NoError(t, err)
+	defer buffer.Destroy()
+	return string(buffer.Bytes())
+}
@@ -3,18 +3,29 @@ package memguarded
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"io/ioutil"
+	"reflect"
 	"strings"
 
+	"github.com/awnumar/memguard"
 	"github.com/n0rad/go-erlog/errs"
 	"github.com/youmark/pkcs8"
 )
 
+// spkiSha256 is the hex encoded sha256 fingerprint of the certificate public key
+func spkiSha256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
 func loadX509KeyPair(certFile, keyFile string, certPassphrase *Service) (cert tls.Certificate, err error) {
 	certPEMBlock, err := ioutil.ReadFile(certFile)
 	if err != nil {
@@ -24,9 +35,35 @@ func loadX509KeyPair(certFile, keyFile string, certPassphrase *Service) (cert tl
 	if err != nil {
 		return
 	}
+	defer memguard.WipeBytes(keyPEMBlock)
 	return X509KeyPair(certPEMBlock, keyPEMBlock, certPassphrase)
 }
 
+// isEncryptedKeyFile returns true if the private key of keyFile needs a passphrase
+func isEncryptedKeyFile(keyFile string) (bool, error) {
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return false, err
+	}
+	defer memguard.WipeBytes(keyPEMBlock)
+
+	for {
+		var keyDERBlock *pem.Block
+		keyDERBlock, keyPEMBlock = pem.Decode(keyPEMBlock)
+		if keyDERBlock == nil {
+			return false, nil
+		}
+		if x509.IsEncryptedPEMBlock(keyDERBlock) || strings.HasPrefix(keyDERBlock.Type, "ENCRYPTED") {
+			return true, nil
+		}
+		if keyDERBlock.Type == "PRIVATE KEY" || strings.HasSuffix(keyDERBlock.Type, " PRIVATE KEY") {
+			return false, nil
+		}
+	}
+}
+
+// X509KeyPair parses a certificate chain and its private key, which is kept in an enclave by the returned
+// certificate PrivateKey. The decrypted key is wiped once sealed, but not keyPEMBlock.
 func X509KeyPair(certPEMBlock, keyPEMBlock []byte, certPassphrase *Service) (cert tls.Certificate, err error) {
 	var certDERBlock *pem.Block
 	for {
@@ -43,6 +80,9 @@ func X509KeyPair(certPEMBlock, keyPEMBlock []byte, certPassphrase *Service) (cer
 		err = errors.New("crypto/tls: failed to parse certificate PEM data")
 		return
 	}
+	var key crypto.PrivateKey
+	defer func() { wipePrivateKey(key) }()
+
 	var keyDERBlock *pem.Block
 	for {
 		keyDERBlock, keyPEMBlock = pem.Decode(keyPEMBlock)
@@ -52,11 +92,12 @@ func X509KeyPair(certPEMBlock, keyPEMBlock []byte, certPassphrase *Service) (cer
 		}
 
 		if x509.IsEncryptedPEMBlock(keyDERBlock) {
-			passphrase, err2 := certPassphrase.Get()
+			passphrase, err2 := openPassphrase(certPassphrase)
 			if err2 != nil {
-				err = errs.WithE(err2, "Failed to get cert passphrase from enclave")
+				err = err2
 				return
 			}
+			defer passphrase.Destroy()
 
 			out, err2 := x509.DecryptPEMBlock(keyDERBlock, passphrase.Bytes())
 			if err2 != nil {
@@ -66,20 +107,24 @@ func X509KeyPair(certPEMBlock, keyPEMBlock []byte, certPassphrase *Service) (cer
 			keyDERBlock.Bytes = out
 			break
 		} else if strings.HasPrefix(keyDERBlock.Type, "ENCRYPTED") {
-			passphrase, err2 := certPassphrase.Get()
+			passphrase, err2 := openPassphrase(certPassphrase)
 			if err2 != nil {
-				err = errs.WithE(err2, "Failed to get cert passphrase from enclave")
+				err = err2
 				return
 			}
+			defer passphrase.Destroy()
 
-			key2, err2 := pkcs8.ParsePKCS8PrivateKeyRSA(keyDERBlock.Bytes, passphrase.Bytes())
+			// PBES2 with any cipher and kdf supported by pkcs8, for any key type
+			decrypted, _, err2 := pkcs8.ParsePrivateKey(keyDERBlock.Bytes, passphrase.Bytes())
 			if err2 != nil {
-				err = errors.New("failed to decrypt pem client file")
+				err = errs.WithE(err2, "Failed to decrypt private key")
 				return
 			}
-
-			keyDERBlock.Bytes = x509.MarshalPKCS1PrivateKey(key2)
-			keyDERBlock.Headers = nil
+			if key, err = checkPrivateKey(decrypted); err != nil {
+				wipePrivateKey(decrypted)
+				return
+			}
+			break
 		}
 
 		if keyDERBlock.Type == "PRIVATE KEY" || strings.HasSuffix(keyDERBlock.Type, " PRIVATE KEY") {
@@ -87,9 +132,12 @@ func X509KeyPair(certPEMBlock, keyPEMBlock []byte, certPassphrase *Service) (cer
 		}
 	}
 
-	cert.PrivateKey, err = parsePrivateKey(keyDERBlock.Bytes)
-	if err != nil {
-		return
+	if key == nil {
+		defer memguard.WipeBytes(keyDERBlock.Bytes)
+		key, err = parsePrivateKey(keyDERBlock.Bytes)
+		if err != nil {
+			return
+		}
 	}
 	// We don't need to parse the public key for TLS, but we so do anyway
 	// to check that it looks sane and matches the private key.
@@ -98,25 +146,18 @@ func X509KeyPair(certPEMBlock, keyPEMBlock []byte, certPassphrase *Service) (cer
 		return
 	}
 
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		err = errors.New("crypto/tls: private key cannot sign")
+		return
+	}
 	switch pub := x509Cert.PublicKey.(type) {
-	case *rsa.PublicKey:
-		priv, ok := cert.PrivateKey.(*rsa.PrivateKey)
-		if !ok {
-			err = errors.New("crypto/tls: private key type does not match public key type")
-			return
-		}
-		if pub.N.Cmp(priv.N) != 0 {
-			err = errors.New("crypto/tls: private key does not match public key")
-			return
-		}
-	case *ecdsa.PublicKey:
-		priv, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
-		if !ok {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		if reflect.TypeOf(pub) != reflect.TypeOf(signer.Public()) {
 			err = errors.New("crypto/tls: private key type does not match public key type")
 			return
-
 		}
-		if pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+		if !pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(signer.Public()) {
 			err = errors.New("crypto/tls: private key does not match public key")
 			return
 		}
@@ -124,23 +165,32 @@ func X509KeyPair(certPEMBlock, keyPEMBlock []byte, certPassphrase *Service) (cer
 		err = errors.New("crypto/tls: unknown public key algorithm")
 		return
 	}
+
+	cert.PrivateKey, err = sealPrivateKey(key)
 	return
 }
 
+func openPassphrase(certPassphrase *Service) (*memguard.LockedBuffer, error) {
+	if certPassphrase == nil {
+		return nil, errs.With("Private key is encrypted but no passphrase is given")
+	}
+	passphrase, err := certPassphrase.Get()
+	if err != nil {
+		return nil, errs.WithE(err, "Failed to get cert passphrase from enclave")
+	}
+	return passphrase, nil
+}
+
 // Attempt to parse the given private key DER block. OpenSSL 0.9.8 generates
 // PKCS#1 private keys by default, while OpenSSL 1.0.0 generates PKCS#8 keys.
 // OpenSSL ecparam generates SEC1 EC private keys for ECDSA. We try all three.
+// Ed25519 keys only exist in PKCS#8.
 func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
 	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
 		return key, nil
 	}
 	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
-		switch key := key.(type) {
-		case *rsa.PrivateKey, *ecdsa.PrivateKey:
-			return key, nil
-		default:
-			return nil, errors.New("crypto/tls: found unknown private key type in PKCS#8 wrapping")
-		}
+		return checkPrivateKey(key)
 	}
 	if key, err := x509.ParseECPrivateKey(der); err == nil {
 		return key, nil
@@ -148,3 +198,13 @@ func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
 
 	return nil, errors.New("crypto/tls: failed to parse private key")
 }
+
+// checkPrivateKey returns key if it is a type usable for TLS
+func checkPrivateKey(key interface{}) (crypto.PrivateKey, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, errors.New("crypto/tls: found unknown private key type in PKCS#8 wrapping")
+	}
+}
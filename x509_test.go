@@ -0,0 +1,179 @@
+package memguarded
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/youmark/pkcs8"
+)
+
+type testKeyFormat struct {
+	name      string
+	encrypted bool
+	// encode returns the key pem, nil when the format does not exist for this key type
+	encode func(t *testing.T, key crypto.Signer, passphrase []byte) []byte
+}
+
+func pbes2Format(name string, opts *pkcs8.Opts) testKeyFormat {
+	return testKeyFormat{name: name, encrypted: true, encode: func(t *testing.T, key crypto.Signer, passphrase []byte) []byte {
+		der, err := pkcs8.MarshalPrivateKey(key, passphrase, opts)
+		require.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der})
+	}}
+}
+
+// traditionalDER returns the PKCS#1 or SEC1 encoding of key, nil for ed25519
+func traditionalDER(t *testing.T, key crypto.Signer) (string, []byte) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		return "EC PRIVATE KEY", der
+	}
+	return "", nil
+}
+
+var testKeyFormats = []testKeyFormat{
+	{name: "pkcs8", encode: func(t *testing.T, key crypto.Signer, _ []byte) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}},
+	{name: "traditional", encode: func(t *testing.T, key crypto.Signer, _ []byte) []byte {
+		blockType, der := traditionalDER(t, key)
+		if der == nil {
+			return nil
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	}},
+	{name: "legacy pem aes256", encrypted: true, encode: func(t *testing.T, key crypto.Signer, passphrase []byte) []byte {
+		blockType, der := traditionalDER(t, key)
+		if der == nil {
+			return nil
+		}
+		block, err := x509.EncryptPEMBlock(rand.Reader, blockType, der, passphrase, x509.PEMCipherAES256)
+		require.NoError(t, err)
+		return pem.EncodeToMemory(block)
+	}},
+	pbes2Format("pbes2 aes128cbc", &pkcs8.Opts{Cipher: pkcs8.AES128CBC, KDFOpts: pkcs8.PBKDF2Opts{SaltSize: 8, IterationCount: 1000, HMACHash: crypto.SHA256}}),
+	pbes2Format("pbes2 aes256cbc", pkcs8Opts),
+	pbes2Format("pbes2 aes256gcm", &pkcs8.Opts{Cipher: pkcs8.AES256GCM, KDFOpts: pkcs8.PBKDF2Opts{SaltSize: 16, IterationCount: 1000, HMACHash: crypto.SHA256}}),
+	pbes2Format("pbes2 3des", &pkcs8.Opts{Cipher: pkcs8.TripleDESCBC, KDFOpts: pkcs8.PBKDF2Opts{SaltSize: 8, IterationCount: 1000, HMACHash: crypto.SHA1}}),
+	pbes2Format("pbes2 scrypt aes256cbc", &pkcs8.Opts{Cipher: pkcs8.AES256CBC, KDFOpts: pkcs8.ScryptOpts{SaltSize: 16, CostParameter: 1 << 10, BlockSize: 8, ParallelizationParameter: 1}}),
+}
+
+func testSelfSigned(t *testing.T, key crypto.Signer) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestX509KeyPair_KeyTypesAndFormats(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keys := []struct {
+		name string
+		key  crypto.Signer
+	}{{"rsa", rsaKey}, {"ecdsa", ecdsaKey}, {"ed25519", ed25519Key}}
+
+	for _, k := range keys {
+		keyName, key := k.name, k.key
+		certPem := testSelfSigned(t, key)
+		for _, format := range testKeyFormats {
+			keyPem := format.encode(t, key, []byte("passphrase"))
+			if keyPem == nil {
+				continue
+			}
+
+			t.Run(keyName+" "+format.name, func(t *testing.T) {
+				cert, err := X509KeyPair(certPem, keyPem, testPassphrase("passphrase"))
+				require.NoError(t, err)
+
+				signer, ok := cert.PrivateKey.(crypto.Signer)
+				require.True(t, ok)
+				assert.True(t, signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()))
+
+				digest := sha256.Sum256([]byte("message"))
+				message, opts := digest[:], crypto.SignerOpts(crypto.SHA256)
+				if keyName == "ed25519" {
+					message, opts = []byte("message"), crypto.Hash(0)
+				}
+				_, err = signer.Sign(rand.Reader, message, opts)
+				assert.NoError(t, err)
+
+				if format.encrypted {
+					_, err = X509KeyPair(certPem, keyPem, testPassphrase("wrong"))
+					assert.Error(t, err)
+				}
+			})
+		}
+	}
+}
+
+func TestX509KeyPair_MismatchedKey(t *testing.T) {
+	_, certKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(otherKey)
+	require.NoError(t, err)
+	_, err = X509KeyPair(testSelfSigned(t, certKey), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil)
+	assert.Error(t, err)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keyDER, err = x509.MarshalPKCS8PrivateKey(ecdsaKey)
+	require.NoError(t, err)
+	_, err = X509KeyPair(testSelfSigned(t, certKey), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil)
+	assert.Error(t, err)
+}
+
+func TestIsEncryptedKeyFile(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	for _, format := range testKeyFormats {
+		keyPem := format.encode(t, key, []byte("passphrase"))
+		if keyPem == nil {
+			continue
+		}
+		file := filepath.Join(dir, format.name)
+		require.NoError(t, os.WriteFile(file, keyPem, 0600))
+
+		encrypted, err := isEncryptedKeyFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, format.encrypted, encrypted, format.name)
+	}
+
+	_, err = isEncryptedKeyFile(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}